@@ -23,12 +23,15 @@ var manager = biscuit.NewSessionManager()
 var templates = template.Must(template.ParseGlob("./*.html"))
 
 type page struct {
-	Title string
+	Title   string
+	Flashes biscuit.FlashList //messages left for this page by the one before it
 }
 
-func renderTemplate(tmpl string, w http.ResponseWriter) {
+func renderTemplate(tmpl string, w http.ResponseWriter, r *http.Request) {
 	buf := new(bytes.Buffer) //get a buffer to write to so we avoid those nasty superfluous writer calls
 	p := page{Title: "Login"}
+	//flashes are cleared as soon as they're read, so refreshing the page makes them go away
+	p.Flashes, _ = manager.Flashes(w, r)
 	err := templates.ExecuteTemplate(buf, tmpl+".html", p)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -55,7 +58,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
-	renderTemplate("login", w)
+	renderTemplate("login", w, r)
 }
 
 func handleValidate(w http.ResponseWriter, r *http.Request) {
@@ -63,12 +66,15 @@ func handleValidate(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	userID, err := manager.NewSession(r.FormValue("username"), r) //create new session in manager by passing a username string and the http request
 	if err != nil {
-		//handle error
+		//flashes survive the redirect, so the login page can tell the user what went wrong
 		log.Println(err)
-		return //for simplicity, since this is just an example
+		manager.AddFlash(w, r, biscuit.FlashError, "Something went wrong, please try again")
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
 	}
-	manager.SetSessionCookie(w, userID)
-	err = manager.Login(userID)
+	//logging in gives the session a new ID, so that nobody who saw the old one can use it, and
+	//sets the session cookie with the new ID for us
+	_, err = manager.Login(w, userID)
 	if err != nil {
 		log.Println(err)
 	}
@@ -77,11 +83,16 @@ func handleValidate(w http.ResponseWriter, r *http.Request) {
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Path[len("/home/"):]
-	cookies := r.Cookies()
+	//the session cookie is signed, so we let the session manager check the signature and hand
+	//us back the session ID inside
+	id, err := manager.ReadSessionCookie(r)
+	if err != nil {
+		manager.AddFlash(w, r, biscuit.FlashWarn, "Please log in first")
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
 	buf := &bytes.Buffer{}
 	fmt.Fprintf(buf, "Congratulations %v! You have successfully logged in.\n\n", name)
-	for _, cookie := range cookies {
-		fmt.Fprintf(buf, "Your cookie ID is %v\n", cookie)
-	}
+	fmt.Fprintf(buf, "Your session ID is %v\n", id)
 	buf.WriteTo(w)
 }
@@ -1,5 +1,10 @@
 module github.com/Jonny-Burkholder/biscuit
 
-go 1.16
+go 1.18
 
-require golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+require (
+	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+)
+
+require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
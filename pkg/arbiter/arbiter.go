@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+
+	"github.com/Jonny-Burkholder/biscuit/pkg/clientip"
 )
 
 /*Arbiter is a subpackage for logging, security, and middleware*/
@@ -11,10 +13,25 @@ import (
 type sessionManager interface {
 	CheckRole(roles []string, id string) error
 	VerifySession(id string) error
+	ReadSessionCookie(r *http.Request) (string, error) //finds the session cookie by whatever name the manager gave it
 }
 
 var logpath string = "../internal/log"
 
+var resolver = clientip.Default
+
+//SetIPResolver sets how the middleware works out who a request came from, for the logs. Give it
+//the same resolver as the session manager, so they agree on what a client's address is. Set it
+//before serving, since it isn't guarded by a lock
+func SetIPResolver(res *clientip.Resolver) {
+	resolver = res
+}
+
+//logRequest logs an error along with the address of the client that caused it
+func logRequest(r *http.Request, err error) {
+	log.Printf("%v: %v", resolver.ClientIP(r), err)
+}
+
 //SetLogPath changes where the
 func SetLogging(path string) error {
 	//is there a way to check to make sure the log path is valid? Maybe try that, return error if invalid
@@ -61,17 +78,17 @@ func CheckPanic(err error) {
 //Restricted wraps a handler to check authentication before allowing a user to access the page, and
 //returns http.Error() if the user is unauthorized. User may decide on a case-to-case basis which
 //roles are able to access each page
-func Restricted(next http.Handler, mng sessionManager, cookieID string, roles ...string) http.Handler { //this needs to be updated to make role variadic
+func Restricted(next http.Handler, mng sessionManager, roles ...string) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(cookieID)
+		id, err := mng.ReadSessionCookie(r)
 		if err != nil {
-			log.Println(err)
+			logRequest(r, err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		if err := mng.VerifySession(cookie.Value); err != nil {
-			log.Println(err)
+		if err := mng.VerifySession(id); err != nil {
+			logRequest(r, err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -80,9 +97,9 @@ func Restricted(next http.Handler, mng sessionManager, cookieID string, roles ..
 			goto serving
 		}
 
-		err = mng.CheckRole(roles, cookie.Value)
+		err = mng.CheckRole(roles, id)
 		if err != nil {
-			log.Println(err)
+			logRequest(r, err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -96,16 +113,18 @@ func Restricted(next http.Handler, mng sessionManager, cookieID string, roles ..
 
 //ValidateSession checks for a valid biscuit session cookie. It returns
 //401 if no such cookie is found
-func ValidateSession(next http.Handler, mng sessionManager, cookieID string) http.Handler {
+func ValidateSession(next http.Handler, mng sessionManager) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(cookieID)
+		id, err := mng.ReadSessionCookie(r)
 		if err != nil {
-			log.Println(err)
+			logRequest(r, err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
-		if err := mng.VerifySession(cookie.Value); err != nil {
-			log.Println(err)
+		if err := mng.VerifySession(id); err != nil {
+			logRequest(r, err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
 		next.ServeHTTP(w, r)
 	}
@@ -114,16 +133,16 @@ func ValidateSession(next http.Handler, mng sessionManager, cookieID string) htt
 
 //ValidateRedirect checks for a valid biscuit session cookie. It redirects to
 //a given endpoint if no such cookie is found
-func ValidateRedirect(next http.Handler, mng sessionManager, cookieID, redirect string) http.Handler {
+func ValidateRedirect(next http.Handler, mng sessionManager, redirect string) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(cookieID)
+		id, err := mng.ReadSessionCookie(r)
 		if err != nil {
-			log.Println(err)
+			logRequest(r, err)
 			http.Redirect(w, r, redirect, http.StatusSeeOther)
 			return
 		}
-		if err := mng.VerifySession(cookie.Value); err != nil {
-			log.Println(err)
+		if err := mng.VerifySession(id); err != nil {
+			logRequest(r, err)
 			http.Redirect(w, r, redirect, http.StatusSeeOther)
 			return
 		}
@@ -1 +1,2630 @@
 package biscuit
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jonny-Burkholder/biscuit/pkg/clientip"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//newTestSQLStore opens a fresh in-memory SQLite database and puts a SQL store on top of it
+func newTestSQLStore(t *testing.T) *sqlStore {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) //every connection to :memory: gets its own database
+	t.Cleanup(func() { db.Close() })
+	store, err := NewSQLStore(db, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLStore(t *testing.T) {
+	store := newTestSQLStore(t)
+	if _, err := NewSQLStore(store.db, DialectSQLite); err != nil {
+		t.Fatalf("running migrations twice: %v", err)
+	}
+
+	mng := NewSessionManager()
+	mng.SetMaxAttempts(3)
+	if err := mng.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil), "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = mng.Login(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.VerifySession(id); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := mng.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.BlockIP(id, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		mng.CountUp(sess)
+	}
+
+	rec, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Username != "bob" || rec.Role != "admin" || rec.Alive != true {
+		t.Errorf("got %+v", rec)
+	}
+	if allowed, ok := rec.IPAddress["10.0.0.1"]; ok != true || allowed != false {
+		t.Errorf("expected 10.0.0.1 to be blocked, got %v", rec.IPAddress)
+	}
+	if rec.Attempts != 3 || rec.Locked != true {
+		t.Errorf("expected session to be locked after 3 attempts, got %v attempts, locked %v", rec.Attempts, rec.Locked)
+	}
+
+	if err := store.DeleteByUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(id); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+//respServer is a tiny stand-in for a Redis server. It only knows the commands the Redis
+//store uses, and it keeps everything in maps, but it speaks real RESP over real TCP
+type respServer struct {
+	mux     sync.Mutex
+	ln      net.Listener
+	strings map[string]string
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+	clock   time.Time //what TTLs are measured against. Tests move it with advance instead of sleeping
+}
+
+func newRESPServer(t *testing.T) *respServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &respServer{
+		ln:      ln,
+		strings: make(map[string]string),
+		sets:    make(map[string]map[string]bool),
+		expires: make(map[string]time.Time),
+		clock:   time.Now(),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *respServer) addr() string {
+	return srv.ln.Addr().String()
+}
+
+//advance moves the server's clock forward, expiring anything whose TTL runs out on the way
+func (srv *respServer) advance(d time.Duration) {
+	srv.mux.Lock()
+	srv.clock = srv.clock.Add(d)
+	srv.mux.Unlock()
+}
+
+func (srv *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	var queue [][]string
+	inMulti := false
+	for {
+		v, err := readRESP(rd)
+		if err != nil {
+			return
+		}
+		raw, _ := v.([]interface{})
+		args := make([]string, len(raw))
+		for i, arg := range raw {
+			b, _ := arg.([]byte)
+			args[i] = string(b)
+		}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "MULTI":
+			inMulti = true
+			queue = nil
+			io.WriteString(conn, "+OK\r\n")
+		case cmd == "DISCARD":
+			inMulti = false
+			io.WriteString(conn, "+OK\r\n")
+		case cmd == "EXEC":
+			inMulti = false
+			srv.mux.Lock()
+			out := "*" + strconv.Itoa(len(queue)) + "\r\n"
+			for _, q := range queue {
+				out += srv.exec(q)
+			}
+			srv.mux.Unlock()
+			io.WriteString(conn, out)
+		case inMulti:
+			queue = append(queue, args)
+			io.WriteString(conn, "+QUEUED\r\n")
+		default:
+			srv.mux.Lock()
+			out := srv.exec(args)
+			srv.mux.Unlock()
+			io.WriteString(conn, out)
+		}
+	}
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+//expire drops a key if its TTL is up. Must be called with srv.mux held
+func (srv *respServer) expire(key string) {
+	if at, ok := srv.expires[key]; ok && srv.clock.After(at) {
+		delete(srv.strings, key)
+		delete(srv.sets, key)
+		delete(srv.expires, key)
+	}
+}
+
+//exec runs one command and returns the encoded reply. Must be called with srv.mux held
+func (srv *respServer) exec(args []string) string {
+	for _, arg := range args[1:] {
+		srv.expire(arg)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH":
+		return "+OK\r\n"
+	case "SET":
+		key, val := args[1], args[2]
+		_, exists := srv.strings[key]
+		keepTTL := false
+		var px time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "XX":
+				if exists != true {
+					return "$-1\r\n"
+				}
+			case "NX":
+				if exists {
+					return "$-1\r\n"
+				}
+			case "KEEPTTL":
+				keepTTL = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				px = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		srv.strings[key] = val
+		if px > 0 {
+			srv.expires[key] = srv.clock.Add(px)
+		} else if keepTTL != true {
+			delete(srv.expires, key)
+		}
+		return "+OK\r\n"
+	case "MGET":
+		out := "*" + strconv.Itoa(len(args)-1) + "\r\n"
+		for _, key := range args[1:] {
+			if val, ok := srv.strings[key]; ok {
+				out += bulk(val)
+			} else {
+				out += "$-1\r\n"
+			}
+		}
+		return out
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			_, isString := srv.strings[key]
+			_, isSet := srv.sets[key]
+			if isString || isSet {
+				n++
+			}
+			delete(srv.strings, key)
+			delete(srv.sets, key)
+			delete(srv.expires, key)
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "EXISTS":
+		if _, ok := srv.strings[args[1]]; ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "INCR":
+		n, _ := strconv.Atoi(srv.strings[args[1]])
+		n++
+		srv.strings[args[1]] = strconv.Itoa(n)
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "SADD":
+		if srv.sets[args[1]] == nil {
+			srv.sets[args[1]] = make(map[string]bool)
+		}
+		srv.sets[args[1]][args[2]] = true
+		return ":1\r\n"
+	case "SREM":
+		delete(srv.sets[args[1]], args[2])
+		return ":1\r\n"
+	case "SMEMBERS":
+		out := "*" + strconv.Itoa(len(srv.sets[args[1]])) + "\r\n"
+		for member := range srv.sets[args[1]] {
+			out += bulk(member)
+		}
+		return out
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		srv.expires[args[1]] = srv.clock.Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "PTTL":
+		if _, ok := srv.strings[args[1]]; ok != true {
+			return ":-2\r\n"
+		}
+		at, ok := srv.expires[args[1]]
+		if ok != true {
+			return ":-1\r\n"
+		}
+		return ":" + strconv.FormatInt(at.Sub(srv.clock).Milliseconds(), 10) + "\r\n"
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[3], "*")
+		var keys []string
+		for key := range srv.strings {
+			srv.expire(key)
+			if _, ok := srv.strings[key]; ok && strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		out := "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			out += bulk(key)
+		}
+		return out
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	srv := newRESPServer(t)
+	store, err := NewRedisStore(srv.addr(), "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	//two managers sharing one store, like two app servers behind a load balancer
+	mngA := NewSessionManager()
+	mngB := NewSessionManager()
+	for _, mng := range []*sessionManager{mngA, mngB} {
+		mng.SetMaxAttempts(4)
+		if err := mng.SetStore(store); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := mngA.NewSession("alice", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = mngA.Login(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mngB.VerifySession(id); err != nil {
+		t.Fatalf("session created on A should verify on B: %v", err)
+	}
+
+	//attempts counted on both servers add up to one lockout
+	var locked int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		mng := []*sessionManager{mngA, mngB}[i%2]
+		go func() {
+			defer wg.Done()
+			sess, err := mng.GetSession(id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := mng.CountUp(sess); err != nil {
+				atomic.AddInt32(&locked, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if locked != 1 {
+		t.Errorf("expected exactly one CountUp to hit the lockout, got %v", locked)
+	}
+	rec, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Attempts != 4 || rec.Locked != true {
+		t.Errorf("expected 4 attempts and a locked session, got %+v", rec)
+	}
+
+	recs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Errorf("expected 1 session, got %v", len(recs))
+	}
+	if err := store.DeleteByUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mngB.VerifySession(id); err == nil {
+		t.Error("expected session to be gone")
+	}
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	srv := newRESPServer(t)
+	store, err := NewRedisStore(srv.addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	mng := NewSessionManager()
+	mng.SetStore(store)
+	mng.SetSessionLength(1)
+	if store.ttl != time.Second {
+		t.Fatalf("expected the store's TTL to follow the session length, got %v", store.ttl)
+	}
+	id, err := mng.NewSession("alice", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	srv.advance(2 * time.Second)
+	if _, err := store.Get(id); err != ErrSessionNotFound {
+		t.Errorf("expected session to have expired, got %v", err)
+	}
+
+	//counting attempts for a session makes them expire with it, and for a session that's gone
+	//doesn't leave a count behind that would never expire
+	store.SetTTL(time.Hour)
+	if err := store.Put(&SessionRecord{ID: "a", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.mux.Lock()
+	srv.expires[store.sessionKey("a")] = srv.clock.Add(time.Minute) //as if it were Put a while ago
+	srv.mux.Unlock()
+	if n, err := store.IncrAttempts("a"); err != nil || n != 1 {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	srv.mux.Lock()
+	left := srv.expires[store.attemptsKey("a")].Sub(srv.clock)
+	srv.mux.Unlock()
+	if left > time.Minute || left < 30*time.Second {
+		t.Errorf("attempts expire in %v, the session in a minute", left)
+	}
+	srv.mux.Lock()
+	delete(srv.strings, store.sessionKey("a")) //as if it expired between reading and counting
+	srv.mux.Unlock()
+	if _, err := store.IncrAttempts("a"); err != ErrSessionNotFound {
+		t.Errorf("counting for a missing session: got %v", err)
+	}
+	srv.mux.Lock()
+	_, orphan := srv.strings[store.attemptsKey("a")]
+	srv.mux.Unlock()
+	if orphan {
+		t.Error("IncrAttempts left a count behind for a session that isn't there")
+	}
+}
+
+//seedSessions puts n logged out sessions straight into the manager's store, with IDs
+//"0" through n-1, so tests can have lots of sessions without paying for NewSession
+func seedSessions(mng *sessionManager, n int) {
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		mng.getStore().Put(&SessionRecord{
+			ID:        strconv.Itoa(i),
+			Username:  "user" + strconv.Itoa(i%16),
+			IPAddress: map[string]bool{"192.0.2.1": true},
+			Created:   now,
+			LastSeen:  now,
+		})
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	mng := NewSessionManager()
+	mng.SetMaxAttempts(1000)
+	seedSessions(mng, 16*50+1)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			for j := 0; j < 50; j++ {
+				id, err := mng.Login(nil, strconv.Itoa(i*50+j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := mng.VerifySessionWithIP(id, r); err != nil {
+					t.Error(err)
+					return
+				}
+				mng.SetSessionLength(3600) //settings can change while sessions are in use
+			}
+		}(i)
+	}
+
+	//everyone hammering the same session at once shouldn't lose any attempts
+	id := strconv.Itoa(16 * 50)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				sess, err := mng.GetSession(id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mng.CountUp(sess)
+			}
+		}()
+	}
+	wg.Wait()
+	sess, err := mng.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.counter.attempts != 160 {
+		t.Errorf("expected 160 attempts, got %v", sess.counter.attempts)
+	}
+}
+
+//withShards swaps a manager's locks and store for ones with n shards
+func withShards(mng *sessionManager, n int) *sessionManager {
+	mng.shards = make([]sync.Mutex, n)
+	mng.SetStore(newMemoryStore(n))
+	return mng
+}
+
+//benchmarkLogin logs sessions in and out from every goroutine at once. Run it with
+//-cpu 1,2,4,8 to see how throughput scales. With one shard, every call waits on the
+//same lock, so extra cores don't buy much
+func benchmarkLogin(b *testing.B, shards int) {
+	mng := withShards(NewSessionManager(), shards)
+	store := mng.getStore()
+	var n uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			//Login rotates the ID, so every iteration needs a session of its own
+			id := strconv.Itoa(int(atomic.AddUint32(&n, 1)))
+			now := time.Now()
+			store.Put(&SessionRecord{ID: id, IPAddress: map[string]bool{}, Created: now, LastSeen: now})
+			id, err := mng.Login(nil, id)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			mng.VerifySession(id)
+			mng.Logout(id)
+			store.Delete(id)
+		}
+	})
+}
+
+func BenchmarkLoginOneShard(b *testing.B) {
+	benchmarkLogin(b, 1)
+}
+
+func BenchmarkLoginSharded(b *testing.B) {
+	benchmarkLogin(b, defaultShardCount)
+}
+
+//BenchmarkVerifySession verifies a pool of already logged in sessions from every goroutine
+func BenchmarkVerifySession(b *testing.B) {
+	mng := NewSessionManager()
+	seedSessions(mng, 1024)
+	for i := 0; i < 1024; i++ {
+		rec, _ := mng.getStore().Get(strconv.Itoa(i))
+		rec.Alive = true
+		mng.getStore().Put(rec)
+	}
+	var n uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint32(&n, 1) * 64
+		for pb.Next() {
+			i++
+			if err := mng.VerifySession(strconv.Itoa(int(i % 1024))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSessionIDs(t *testing.T) {
+	//these all land in the same second, which used to hand out the same ID every time
+	mng := NewSessionManager()
+	r := httptest.NewRequest("GET", "/", nil)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := mng.NewSession("user", r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate session ID %q", id)
+		}
+		seen[id] = true
+	}
+
+	for _, tc := range []struct {
+		length, encoding, want int
+	}{
+		{32, EncodingBase64URL, 43},
+		{32, EncodingHex, 64},
+		{16, EncodingHex, 32},
+	} {
+		g, err := NewRandomIDGenerator(tc.length, tc.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := g.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != tc.want {
+			t.Errorf("%v bytes with encoding %v: got %q, want %v characters", tc.length, tc.encoding, id, tc.want)
+		}
+	}
+	if _, err := NewRandomIDGenerator(8, EncodingHex); err == nil {
+		t.Error("expected an error for an 8 byte ID")
+	}
+
+	mng.SetIDGenerator(NewUUIDv7Generator())
+	first, err := mng.NewSession("user", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	second, err := mng.NewSession("user", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 36 || first[14] != '7' || strings.IndexByte("89ab", first[19]) < 0 {
+		t.Errorf("not a UUIDv7: %q", first)
+	}
+	if first >= second {
+		t.Errorf("UUIDv7s out of order: %q, %q", first, second)
+	}
+}
+
+//requestWithCookies makes a request carrying every cookie the recorder was sent
+func requestWithCookies(rec *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+//withConsent makes a request look like the consent middleware ran and found the categories
+func withConsent(r *http.Request, categories ...string) *http.Request {
+	consent := defaultConsent()
+	for _, category := range categories {
+		consent.Categories[category] = true
+	}
+	return r.WithContext(context.WithValue(r.Context(), consentKey{}, consent))
+}
+
+func TestSignedCookies(t *testing.T) {
+	mng := NewSessionManager()
+	id, err := mng.NewSession("user", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := mng.SetSessionCookie(w, id); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mng.ReadSessionCookie(requestWithCookies(w))
+	if err != nil || got != id {
+		t.Fatalf("got %q, %v, want %q", got, err, id)
+	}
+
+	c := w.Result().Cookies()[0]
+	tampered := *c
+	tampered.Value = "x" + c.Value
+	if _, err := mng.VerifyCookie(&tampered); err != ErrInvalidSignature {
+		t.Errorf("tampered value: got %v", err)
+	}
+	renamed := *c
+	renamed.Name = "other"
+	if _, err := mng.VerifyCookie(&renamed); err != ErrInvalidSignature {
+		t.Errorf("renamed cookie: got %v", err)
+	}
+
+	//rotate: the new key signs, the old one still verifies until it's removed
+	oldSecret := mng.getKeyring().keys[defaultKeyID]
+	k, err := NewKeyring("new", []byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.AddKey("old", oldSecret); err != nil {
+		t.Fatal(err)
+	}
+	mng.SetKeyring(k)
+	if got, err := mng.VerifyCookie(c); err != nil || got != id {
+		t.Errorf("old key after rotation: got %q, %v", got, err)
+	}
+	if err := k.RemoveKey("new"); err == nil {
+		t.Error("removed the active key")
+	}
+	if err := k.RemoveKey("old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mng.VerifyCookie(c); err != ErrInvalidSignature {
+		t.Errorf("removed key: got %v", err)
+	}
+	if _, err := NewKeyring("short", []byte("too short")); err == nil {
+		t.Error("accepted a short key")
+	}
+
+	mng.SetSessionLength(60)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: mng.SessionCookie(), Value: k.sign(mng.SessionCookie(), id, time.Now().Add(-2*time.Minute))})
+	if _, err := mng.ReadSessionCookie(r); err != ErrCookieExpired {
+		t.Errorf("old cookie: got %v", err)
+	}
+}
+
+func TestEncryptedCookies(t *testing.T) {
+	mng := NewSessionManager()
+	for _, kind := range []int{CipherXChaCha20Poly1305, CipherAESGCM} {
+		if err := mng.SetCipher(kind); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if err := mng.SetEncryptedCookie(w, nil, "state", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		data, err := mng.ReadEncryptedCookie(requestWithCookies(w), "state")
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("cipher %v: got %q, %v", kind, data, err)
+		}
+		value := w.Result().Cookies()[0].Value
+		if strings.Contains(value, "hello") {
+			t.Errorf("cipher %v: plaintext in cookie %q", kind, value)
+		}
+		if _, err := mng.Decrypt("other", value); err != ErrInvalidCiphertext {
+			t.Errorf("cipher %v: swapped cookie: got %v", kind, err)
+		}
+		i := strings.IndexByte(value, '.')
+		sealed, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed[len(sealed)-1] ^= 1
+		tampered := value[:i+1] + base64.RawURLEncoding.EncodeToString(sealed)
+		if _, err := mng.Decrypt("state", tampered); err != ErrInvalidCiphertext {
+			t.Errorf("cipher %v: tampered value: got %v", kind, err)
+		}
+	}
+	if err := mng.SetCipher(42); err == nil {
+		t.Error("accepted an unknown cipher")
+	}
+
+	value, err := mng.Encrypt("state", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := mng.getKeyring()
+	if err := k.AddKey("next", []byte(strings.Repeat("n", 32))); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.SetActive("next"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := mng.Decrypt("state", value); err != nil || string(data) != "hello" {
+		t.Errorf("old key after rotation: got %q, %v", data, err)
+	}
+	rotated, err := mng.Encrypt("state", []byte("hello"))
+	if err != nil || strings.HasPrefix(rotated, "next.") != true {
+		t.Errorf("not encrypted with the active key: %q, %v", rotated, err)
+	}
+	k.RemoveKey(defaultKeyID)
+	if _, err := mng.Decrypt("state", value); err != ErrInvalidCiphertext {
+		t.Errorf("removed key: got %v", err)
+	}
+}
+
+func TestStatelessSessions(t *testing.T) {
+	//two servers that share keys but not a store
+	k, err := NewKeyring("edge", []byte(strings.Repeat("e", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := NewSessionManager(), NewSessionManager()
+	for _, mng := range []*sessionManager{a, b} {
+		mng.SetKeyring(k)
+		mng.SetStateless(true)
+		mng.SetSessionLength(60)
+	}
+
+	id, err := a.NewSession("user", httptest.NewRequest("GET", "/", nil), "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = a.Login(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := a.SetSessionCookie(w, id); err != nil {
+		t.Fatal(err)
+	}
+	if value := w.Result().Cookies()[0].Value; strings.Contains(value, "admin") {
+		t.Errorf("session in the clear: %q", value)
+	}
+
+	r := requestWithCookies(w)
+	got, err := b.ReadSessionCookie(r)
+	if err != nil || got != id {
+		t.Fatalf("got %q, %v, want %q", got, err, id)
+	}
+	if err := b.VerifySession(id); err != nil {
+		t.Error(err)
+	}
+	if role, err := b.GetRole(id); err != nil || role != "admin" {
+		t.Errorf("got role %q, %v", role, err)
+	}
+
+	if err := b.Logout(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ReadSessionCookie(r); err != ErrSessionRevoked {
+		t.Errorf("cookie after logout: got %v", err)
+	}
+	b.revokedMux.Lock()
+	until := b.revoked[id]
+	b.revokedMux.Unlock()
+	a.Revoke(id, until)
+	if _, err := a.ReadSessionCookie(r); err != ErrSessionRevoked {
+		t.Errorf("cookie after passing the revocation along: got %v", err)
+	}
+	a.pruneRevoked(until.Add(time.Second))
+	if a.isRevoked(id) {
+		t.Error("revocation outlived the cookie")
+	}
+
+	big, err := a.NewSession("user", httptest.NewRequest("GET", "/", nil), strings.Repeat("r", maxCookieSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if err := a.SetSessionCookie(w, big); err != nil {
+		t.Fatalf("oversized session: got %v", err)
+	}
+	if len(w.Result().Cookies()) < 2 {
+		t.Error("oversized session wasn't split into chunks")
+	}
+	if got, err := a.ReadSessionCookie(requestWithCookies(w)); err != nil || got != big {
+		t.Errorf("reading a chunked session: got %q, %v", got, err)
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	mng := NewSessionManager()
+	oldID, err := mng.NewSession("user", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	id, err := mng.Login(w, oldID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == oldID {
+		t.Fatal("Login didn't rotate the session ID")
+	}
+	if got, err := mng.ReadSessionCookie(requestWithCookies(w)); err != nil || got != id {
+		t.Errorf("cookie wasn't reissued: got %q, %v", got, err)
+	}
+	if err := mng.VerifySession(oldID); err == nil {
+		t.Error("the ID from before login still works")
+	}
+
+	//a grace window never applies when a session gains privileges, or a planted ID would get them
+	mng.SetRotationGrace(60)
+	fixed, err := mng.NewSession("victim", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loggedIn, err := mng.Login(nil, fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.VerifySession(fixed); err == nil {
+		t.Error("the ID from before login works inside the grace window")
+	}
+	if _, err := mng.SetRole(nil, loggedIn, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if role, err := mng.GetRole(loggedIn); err == nil {
+		t.Errorf("the ID from before SetRole got role %q", role)
+	}
+
+	//otherwise the old ID follows the session for a little while
+	adminID, err := mng.RotateSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.VerifySession(id); err != nil {
+		t.Errorf("old ID inside the grace window: %v", err)
+	}
+	if name, err := mng.GetNameFromID(id); err != nil || name != "user" {
+		t.Errorf("old ID should see the new session, got %q, %v", name, err)
+	}
+	if _, err := mng.RotateSession(id); err == nil {
+		t.Error("rotated an ID that was already rotated")
+	}
+
+	rec, err := mng.getStore().Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.RotatedTo != adminID {
+		t.Errorf("old record points to %q, want %q", rec.RotatedTo, adminID)
+	}
+	rec.RotatedUntil = time.Now().Add(-time.Second)
+	mng.getStore().Put(rec)
+	mng.sweep()
+	if _, err := mng.getStore().Get(id); err != ErrSessionNotFound {
+		t.Errorf("old ID outlived its grace window: %v", err)
+	}
+	if err := mng.VerifySession(adminID); err != nil {
+		t.Error(err)
+	}
+
+	//logging out through the old ID inside the grace window logs out the new one. It has to hold
+	//the new ID's lock to do it, or a write to the new ID at the same time could undo it
+	newID, err := mng.RotateSession(adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock := mng.lockSession(newID)
+	done := make(chan error)
+	go func() { done <- mng.Logout(adminID) }()
+	select {
+	case err := <-done:
+		t.Errorf("Logout didn't wait for the new ID's lock: %v", err)
+		unlock()
+	case <-time.After(50 * time.Millisecond):
+		unlock()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mng.VerifySession(newID); err == nil {
+		t.Error("logging out through the old ID left the new one logged in")
+	}
+
+	//the SQL store has to keep the rotation fields too
+	store := newTestSQLStore(t)
+	if err := store.Put(rec); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RotatedTo != adminID || got.RotatedUntil.Equal(rec.RotatedUntil) != true {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestCookieOptions(t *testing.T) {
+	mng := NewSessionManager()
+	id, err := mng.NewSession("user", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := mng.SetSessionCookie(w, id); err != nil {
+		t.Fatal(err)
+	}
+	header := w.Header().Get("Set-Cookie")
+	for _, want := range []string{"Path=/", "HttpOnly", "SameSite=Lax"} {
+		if strings.Contains(header, want) != true {
+			t.Errorf("default cookie %q is missing %q", header, want)
+		}
+	}
+
+	if err := mng.SetCookieOptions(CookieOptions{SameSite: http.SameSiteNoneMode}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mng.SetSessionCookie(w, id)
+	if header := w.Header().Get("Set-Cookie"); strings.Contains(header, "; Secure") != true {
+		t.Errorf("SameSite=None without Secure: %q", header)
+	}
+
+	for _, bad := range []CookieOptions{
+		{Prefix: PrefixHost, Secure: true, Path: "/", Domain: "example.com"},
+		{Prefix: PrefixHost, Secure: true, Path: "/app"},
+		{Prefix: PrefixSecure},
+		{Partitioned: true},
+		{Path: "app"},
+		{Domain: "example.com; Max-Age=99999"},
+	} {
+		if err := mng.SetCookieOptions(bad); err == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+
+	opts := CookieOptions{Secure: true, SameSite: http.SameSiteStrictMode, Path: "/", Partitioned: true, Prefix: PrefixHost}
+	if err := mng.SetCookieOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if err := mng.SetSessionCookie(w, id); err != nil {
+		t.Fatal(err)
+	}
+	header = w.Header().Get("Set-Cookie")
+	if strings.HasPrefix(header, "__Host-"+defaultSessionCookieName+"=") != true || strings.HasSuffix(header, "; Partitioned") != true {
+		t.Errorf("got %q", header)
+	}
+	if got, err := mng.ReadSessionCookie(requestWithCookies(w)); err != nil || got != id {
+		t.Errorf("reading a prefixed cookie: got %q, %v", got, err)
+	}
+
+	w = httptest.NewRecorder()
+	mng.DeleteCookie(w, &http.Cookie{Name: mng.SessionCookie()})
+	header = w.Header().Get("Set-Cookie")
+	if strings.Contains(header, "Max-Age=0") != true || strings.Contains(header, "Path=/") != true {
+		t.Errorf("deleting: got %q", header)
+	}
+}
+
+func TestCookieNames(t *testing.T) {
+	//two apps on one domain, each with its own session cookie
+	shop, blog := NewSessionManager(), NewSessionManager()
+	if err := shop.SetCookieNames(CookieNames{Session: "shop_session"}); err != nil {
+		t.Fatal(err)
+	}
+	if shop.SessionCookie() != "shop_session" || shop.PreferenceCookie() != defaultPreferenceCookieName {
+		t.Errorf("got %q and %q", shop.SessionCookie(), shop.PreferenceCookie())
+	}
+	shopID, err := shop.NewSession("user", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blogID, err := blog.NewSession("user", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	shop.SetSessionCookie(w, shopID)
+	blog.SetSessionCookie(w, blogID)
+	r := requestWithCookies(w)
+	if got, err := shop.ReadSessionCookie(r); err != nil || got != shopID {
+		t.Errorf("shop: got %q, %v", got, err)
+	}
+	if got, err := blog.ReadSessionCookie(r); err != nil || got != blogID {
+		t.Errorf("blog: got %q, %v", got, err)
+	}
+
+	for _, bad := range []CookieNames{
+		{Session: "has space"},
+		{Session: "semi;colon"},
+		{Session: "same", Preference: "same"},
+	} {
+		if err := shop.SetCookieNames(bad); err == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	type prefs struct {
+		Theme string `json:"theme"`
+	}
+	mng := NewSessionManager()
+	w := httptest.NewRecorder()
+	if err := mng.SetPreferences(w, httptest.NewRequest("GET", "/", nil), prefs{Theme: "dark"}); err != ErrNoConsent {
+		t.Errorf("setting preferences without consent: got %v", err)
+	}
+	if err := mng.SetPreferences(w, withConsent(httptest.NewRequest("GET", "/", nil), ConsentPreferences), prefs{Theme: "dark"}); err != nil {
+		t.Fatal(err)
+	}
+	c := w.Result().Cookies()[0]
+	raw, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil || string(raw) != `{"v":0,"d":{"theme":"dark"}}` {
+		t.Errorf("got %q, %v", raw, err)
+	}
+	if c.HttpOnly != true {
+		t.Error("preferences should be HttpOnly unless JS access is turned on")
+	}
+	var got prefs
+	if err := mng.GetPreferences(withConsent(requestWithCookies(w), ConsentPreferences), &got); err != nil || got.Theme != "dark" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	//version 0 was {"dark": true}, version 1 is {"theme": "dark"}
+	old := w
+	mng.SetPreferenceOptions(PreferenceOptions{Version: 1, Signed: true, JSAccess: true})
+	if err := mng.GetPreferences(withConsent(requestWithCookies(old), ConsentPreferences), &got); err == nil {
+		t.Error("read unsigned preferences with signing on")
+	}
+	mng.AddPreferenceMigration(0, func(old json.RawMessage) (json.RawMessage, error) {
+		var v0 struct{ Dark bool }
+		if err := json.Unmarshal(old, &v0); err != nil {
+			return nil, err
+		}
+		if v0.Dark {
+			return json.RawMessage(`{"theme":"dark"}`), nil
+		}
+		return json.RawMessage(`{"theme":"light"}`), nil
+	})
+	v0 := base64.RawURLEncoding.EncodeToString([]byte(`{"v":0,"d":{"Dark":true}}`))
+	r := withConsent(httptest.NewRequest("GET", "/", nil), ConsentPreferences)
+	r.AddCookie(&http.Cookie{Name: mng.PreferenceCookie(), Value: mng.getKeyring().sign(mng.PreferenceCookie(), v0, time.Now())})
+	got = prefs{}
+	if err := mng.GetPreferences(r, &got); err != nil || got.Theme != "dark" {
+		t.Errorf("migrating: got %+v, %v", got, err)
+	}
+
+	w = httptest.NewRecorder()
+	if err := mng.SetPreferences(w, r, prefs{Theme: "light"}); err != nil {
+		t.Fatal(err)
+	}
+	c = w.Result().Cookies()[0]
+	if c.HttpOnly {
+		t.Error("JS access is on, but the cookie is HttpOnly")
+	}
+	c.Value = base64.RawURLEncoding.EncodeToString([]byte(`{"v":1,"d":{"theme":"hacked"}}`)) + c.Value[strings.IndexByte(c.Value, '|'):]
+	r = withConsent(httptest.NewRequest("GET", "/", nil), ConsentPreferences)
+	r.AddCookie(c)
+	if err := mng.GetPreferences(r, &got); err != ErrInvalidSignature {
+		t.Errorf("tampered preferences: got %v", err)
+	}
+
+	if err := mng.SetPreferences(httptest.NewRecorder(), r, prefs{Theme: strings.Repeat("x", maxCookieSize)}); err != ErrCookieTooLarge {
+		t.Errorf("oversized preferences: got %v", err)
+	}
+}
+
+func TestPerformanceCookies(t *testing.T) {
+	mng := NewSessionManager()
+	w := httptest.NewRecorder()
+	if _, err := mng.TrackVisit(w, httptest.NewRequest("GET", "/", nil)); err != ErrNoConsent {
+		t.Errorf("tracking without consent: got %v", err)
+	}
+	if header := w.Header().Get("Set-Cookie"); header != "" {
+		t.Errorf("set a cookie without consent: %q", header)
+	}
+
+	mng.SetAnalyticsConsent(func(r *http.Request) bool { return r.Header.Get("X-Consent") == "yes" })
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Consent", "yes")
+	w = httptest.NewRecorder()
+	first, err := mng.TrackVisit(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == "" || first.Visits != 1 {
+		t.Errorf("new visitor: got %+v", first)
+	}
+
+	r = requestWithCookies(w)
+	r.Header.Set("X-Consent", "yes")
+	again, err := mng.TrackVisit(httptest.NewRecorder(), r)
+	if err != nil || again.ID != first.ID || again.Visits != 1 {
+		t.Errorf("same visit: got %+v, %v", again, err)
+	}
+
+	//coming back after a while is a new visit
+	first.LastSeen = time.Now().Add(-time.Hour)
+	data, _ := json.Marshal(first)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Consent", "yes")
+	r.AddCookie(&http.Cookie{
+		Name:  mng.PerformanceCookie(),
+		Value: mng.getKeyring().sign(mng.PerformanceCookie(), base64.RawURLEncoding.EncodeToString(data), time.Now()),
+	})
+	later, err := mng.TrackVisit(httptest.NewRecorder(), r)
+	if err != nil || later.ID != first.ID || later.Visits != 2 {
+		t.Errorf("return visit: got %+v, %v", later, err)
+	}
+
+	var beacons []*Beacon
+	h := mng.BeaconHandler(func(b *Beacon) { beacons = append(beacons, b) })
+	beacon := func(consent string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/beacon", strings.NewReader(`{"page":"/home","timings":{"ttfb":12.5}}`))
+		r.Header.Set("X-Consent", consent)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	if rec := beacon("no"); rec.Code != http.StatusNoContent || len(beacons) != 0 {
+		t.Errorf("beacon without consent: %v, %v recorded", rec.Code, len(beacons))
+	}
+	if rec := beacon("yes"); rec.Code != http.StatusNoContent || len(beacons) != 1 {
+		t.Fatalf("beacon: %v, %v recorded", rec.Code, len(beacons))
+	}
+	if b := beacons[0]; b.VisitorID != first.ID || b.Page != "/home" || b.Timings["ttfb"] != 12.5 {
+		t.Errorf("got %+v", b)
+	}
+}
+
+func TestConsent(t *testing.T) {
+	mng := NewSessionManager()
+	consent := mng.GetConsent(httptest.NewRequest("GET", "/", nil))
+	if consent.Allowed(ConsentNecessary) != true || consent.Allowed(ConsentPreferences) || consent.Allowed(ConsentAnalytics) || consent.Allowed(ConsentMarketing) {
+		t.Errorf("default consent should only allow necessary cookies, got %+v", consent)
+	}
+	if _, err := mng.SetConsent(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), map[string]bool{"tracking": true}); err == nil {
+		t.Error("set consent for an unknown category")
+	}
+
+	w := httptest.NewRecorder()
+	if _, err := mng.SetConsent(w, httptest.NewRequest("GET", "/", nil), map[string]bool{ConsentPreferences: true, ConsentAnalytics: true}); err != nil {
+		t.Fatal(err)
+	}
+	consent = mng.GetConsent(requestWithCookies(w))
+	if consent.Allowed(ConsentPreferences) != true || consent.Allowed(ConsentAnalytics) != true || consent.Allowed(ConsentMarketing) {
+		t.Errorf("got %+v", consent)
+	}
+	if _, err := mng.TrackVisit(httptest.NewRecorder(), requestWithCookies(w)); err != nil {
+		t.Errorf("analytics should follow the consent cookie, got %v", err)
+	}
+
+	//the middleware puts consent in the context, and deletes cookies the user took back
+	r := requestWithCookies(w)
+	prefs := httptest.NewRecorder()
+	if err := mng.SetPreferences(prefs, r, map[string]string{"theme": "dark"}); err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(prefs.Result().Cookies()[0])
+	var seen *Consent
+	h := mng.ConsentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = ConsentFromContext(r.Context())
+		if _, err := mng.SetConsent(w, r, map[string]bool{ConsentAnalytics: true}); err != nil {
+			t.Error(err)
+		}
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if seen == nil || seen.Allowed(ConsentPreferences) || seen.Allowed(ConsentAnalytics) != true {
+		t.Errorf("context should see the new consent, got %+v", seen)
+	}
+	deleted := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == mng.PreferenceCookie() && c.MaxAge < 0 {
+			deleted = true
+		}
+	}
+	if deleted != true {
+		t.Error("preferences cookie wasn't deleted after consent was taken back")
+	}
+
+	//a new policy version means asking again
+	mng.SetConsentPolicyVersion(2)
+	if consent := mng.GetConsent(requestWithCookies(w)); consent.Allowed(ConsentAnalytics) {
+		t.Error("consent from an old policy version still counts")
+	}
+}
+
+func TestChunkedCookies(t *testing.T) {
+	mng := NewSessionManager()
+	big := []byte(strings.Repeat("0123456789", 1000))
+	w := httptest.NewRecorder()
+	if err := mng.SetEncryptedCookie(w, nil, "state", big); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) < 3 {
+		t.Fatalf("expected the value to be split, got %v cookies", len(cookies))
+	}
+	for _, c := range cookies {
+		if len(c.Name)+len(c.Value)+1 > maxCookieSize {
+			t.Errorf("cookie %v is %v bytes", c.Name, len(c.Name)+len(c.Value)+1)
+		}
+	}
+	r := requestWithCookies(w)
+	if data, err := mng.ReadEncryptedCookie(r, "state"); err != nil || string(data) != string(big) {
+		t.Fatalf("reassembling: got %v bytes, %v", len(data), err)
+	}
+
+	//a missing or swapped chunk is caught
+	missing := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		if c.Name != "state.1" {
+			missing.AddCookie(c)
+		}
+	}
+	if _, err := mng.ReadEncryptedCookie(missing, "state"); err != ErrInvalidChunks {
+		t.Errorf("missing chunk: got %v", err)
+	}
+	values := make(map[string]string)
+	for _, c := range cookies {
+		values[c.Name] = c.Value
+	}
+	swapped := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		switch c.Name {
+		case "state.0":
+			c = &http.Cookie{Name: c.Name, Value: values["state.1"]}
+		case "state.1":
+			c = &http.Cookie{Name: c.Name, Value: values["state.0"]}
+		}
+		swapped.AddCookie(c)
+	}
+	if _, err := mng.ReadEncryptedCookie(swapped, "state"); err != ErrInvalidChunks {
+		t.Errorf("swapped chunk: got %v", err)
+	}
+
+	//shrinking the value cleans up the old chunks
+	w = httptest.NewRecorder()
+	if err := mng.SetEncryptedCookie(w, r, "state", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	deleted := make(map[string]bool)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			deleted[c.Name] = true
+		}
+	}
+	for _, c := range cookies {
+		if c.Name != "state" && deleted[c.Name] != true {
+			t.Errorf("stale chunk %v wasn't deleted", c.Name)
+		}
+	}
+	if data, err := mng.ReadEncryptedCookie(requestWithCookies(w), "state"); err != nil || string(data) != "small" {
+		t.Errorf("after shrinking: got %q, %v", data, err)
+	}
+
+	//deleting the header deletes every chunk
+	header, err := r.Cookie("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if err := mng.DeleteCookie(w, header); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(w.Result().Cookies()); got != len(cookies) {
+		t.Errorf("deleted %v cookies, expected %v", got, len(cookies))
+	}
+
+	//so does deleting by name alone, which is all a handler without the request has to go on
+	w = httptest.NewRecorder()
+	if err := mng.DeleteCookie(w, &http.Cookie{Name: "state"}); err != nil {
+		t.Fatal(err)
+	}
+	deleted = make(map[string]bool)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			deleted[c.Name] = true
+		}
+	}
+	for _, c := range cookies {
+		if deleted[c.Name] != true {
+			t.Errorf("bare DeleteCookie left %v behind", c.Name)
+		}
+	}
+	if w.Result().Cookies()[0].Name != "state" {
+		t.Error("the header should be deleted first")
+	}
+
+	if err := mng.SetEncryptedCookie(httptest.NewRecorder(), nil, "state", make([]byte, maxChunks*maxCookieSize)); err != ErrCookieTooLarge {
+		t.Errorf("too many chunks: got %v", err)
+	}
+}
+
+func TestFlashes(t *testing.T) {
+	mng := NewSessionManager()
+	if err := mng.AddFlash(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), "debug", "hi"); err == nil {
+		t.Error("added a flash with an unknown level")
+	}
+
+	//without a session, flashes go in a signed cookie
+	w := httptest.NewRecorder()
+	if err := mng.AddFlash(w, httptest.NewRequest("GET", "/", nil), FlashError, "wrong password"); err != nil {
+		t.Fatal(err)
+	}
+	w2 := httptest.NewRecorder()
+	if err := mng.AddFlash(w2, requestWithCookies(w), FlashInfo, "try again"); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	flashes, err := mng.Flashes(w, requestWithCookies(w2))
+	if err != nil || len(flashes) != 2 {
+		t.Fatalf("got %v, %v", flashes, err)
+	}
+	if errs := flashes.ByLevel(FlashError); len(errs) != 1 || errs[0].String() != "wrong password" || flashes.Has(FlashWarn) {
+		t.Errorf("got %v", flashes)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Name != mng.FlashCookie() || c[0].MaxAge >= 0 {
+		t.Errorf("flash cookie wasn't deleted after reading: %v", c)
+	}
+
+	//with a session, they go in the store, and survive a rotation
+	mng.SetStore(newTestSQLStore(t))
+	id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if err := mng.SetSessionCookie(w, id); err != nil {
+		t.Fatal(err)
+	}
+	r := requestWithCookies(w)
+	mng.SetRotationGrace(60)
+	if _, err := mng.RotateSession(id); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	if err := mng.AddFlash(w, r, FlashInfo, "logged in"); err != nil {
+		t.Fatal(err)
+	}
+	if header := w.Header().Get("Set-Cookie"); header != "" {
+		t.Errorf("flash for a session set a cookie: %q", header)
+	}
+	if flashes, err := mng.Flashes(httptest.NewRecorder(), r); err != nil || len(flashes) != 1 || flashes[0].Message != "logged in" {
+		t.Errorf("got %v, %v", flashes, err)
+	}
+	if flashes, err := mng.Flashes(httptest.NewRecorder(), r); err != nil || len(flashes) != 0 {
+		t.Errorf("flashes should only be read once, got %v, %v", flashes, err)
+	}
+}
+
+//countingStore counts the sessions written to the store it wraps
+type countingStore struct {
+	SessionStore
+	puts int32
+}
+
+func (s *countingStore) Put(rec *SessionRecord) error {
+	atomic.AddInt32(&s.puts, 1)
+	return s.SessionStore.Put(rec)
+}
+
+func TestSessionData(t *testing.T) {
+	type cart struct {
+		Items []string
+		Total int
+	}
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		mng := NewSessionManager()
+		mng.SetCodec(codec)
+		store := &countingStore{SessionStore: newTestSQLStore(t)}
+		mng.SetStore(store)
+		id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mng.Get(id, "cart", &cart{}); err != ErrKeyNotFound {
+			t.Errorf("missing key: got %v", err)
+		}
+		want := cart{Items: []string{"apple", "pear"}, Total: 3}
+		if err := SetValue(mng, id, "cart", want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := GetValue[cart](mng, id, "cart")
+		if err != nil || len(got.Items) != 2 || got.Items[1] != "pear" || got.Total != 3 {
+			t.Errorf("got %+v, %v", got, err)
+		}
+		if n, err := GetValue[int](mng, id, "cart"); err == nil {
+			t.Errorf("decoded a cart into an int: %v", n)
+		}
+
+		//nothing is written back unless something changed
+		puts := atomic.LoadInt32(&store.puts)
+		mng.Set(id, "cart", want)
+		mng.Get(id, "cart", &got)
+		mng.Delete(id, "nothing")
+		mng.Update(id, func(d *SessionData) error {
+			d.Set("other", 1)
+			return errors.New("changed my mind")
+		})
+		if n := atomic.LoadInt32(&store.puts); n != puts {
+			t.Errorf("%v unnecessary writes", n-puts)
+		}
+		if err := mng.Delete(id, "cart"); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt32(&store.puts) != puts+1 {
+			t.Error("deleting a key wasn't written back")
+		}
+		if _, err := GetValue[cart](mng, id, "cart"); err != ErrKeyNotFound {
+			t.Errorf("deleted key: got %v", err)
+		}
+
+		//values follow the session when it's rotated
+		mng.Set(id, "n", 42)
+		newID, err := mng.Login(nil, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := GetValue[int](mng, newID, "n"); err != nil || n != 42 {
+			t.Errorf("after rotation: got %v, %v", n, err)
+		}
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	newSessions := func(mng *sessionManager, n int) []string {
+		var ids []string
+		for i := 0; i < n; i++ {
+			id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+			time.Sleep(time.Millisecond) //so creation times are in order
+		}
+		return ids
+	}
+	alive := func(mng *sessionManager) map[string]bool {
+		recs, err := mng.ListUserSessions("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]bool)
+		for _, rec := range recs {
+			m[rec.ID] = true
+		}
+		return m
+	}
+
+	mng := NewSessionManager()
+	newSessions(mng, 3) //no limit by default
+	mng.SetMaxSessionsPerUser(3)
+	if _, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil)); err != ErrTooManySessions {
+		t.Errorf("over the limit: got %v", err)
+	}
+	if _, err := mng.NewSession("alice", httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Errorf("other users aren't limited by bob: %v", err)
+	}
+	if err := mng.SetSessionLimitPolicy(42); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+
+	mng = NewSessionManager()
+	mng.SetMaxSessionsPerUser(2)
+	mng.SetSessionLimitPolicy(LimitEvictOldest)
+	ids := newSessions(mng, 3)
+	if m := alive(mng); len(m) != 2 || m[ids[0]] || m[ids[1]] != true || m[ids[2]] != true {
+		t.Errorf("evict oldest: got %v from %v", m, ids)
+	}
+
+	mng = NewSessionManager()
+	mng.SetStore(newTestSQLStore(t))
+	mng.SetMaxSessionsPerUser(2)
+	mng.SetSessionLimitPolicy(LimitEvictLRU)
+	ids = newSessions(mng, 2)
+	mng.touch(ids[0]) //the older one has been used more recently
+	ids = append(ids, newSessions(mng, 1)...)
+	if m := alive(mng); len(m) != 2 || m[ids[0]] != true || m[ids[1]] || m[ids[2]] != true {
+		t.Errorf("evict LRU: got %v from %v", m, ids)
+	}
+
+	//rotated sessions are only counted once, and "log out everywhere else" keeps the session
+	//that asked even if it asks with its old ID
+	mng.SetRotationGrace(60)
+	newID, err := mng.RotateSession(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := alive(mng); len(m) != 2 || m[newID] != true || m[ids[0]] {
+		t.Errorf("after rotation: got %v", m)
+	}
+	if err := mng.RevokeAllForUser("bob", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if m := alive(mng); len(m) != 1 || m[newID] != true {
+		t.Errorf("after revoking the others: got %v", m)
+	}
+	if _, err := mng.GetSession(ids[2]); err == nil {
+		t.Error("revoked session still works")
+	}
+	if err := mng.RevokeAllForUser("bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if m := alive(mng); len(m) != 0 {
+		t.Errorf("after revoking everything: got %v", m)
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	const chrome = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/125.0.6422.165 Mobile Safari/537.36"
+	request := func(ua, lang string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", ua)
+		r.Header.Set("Accept-Language", lang)
+		return r
+	}
+	fp := NewFingerprint(request(chrome, "en-US,en;q=0.9"))
+	if fp.Browser != "Chrome" || fp.Version != 125 || fp.OS != "Android" || fp.Mobile != true || fp.Language != "en-us" {
+		t.Errorf("got %v", fp)
+	}
+	edge := NewFingerprint(request("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.2592.68", ""))
+	if edge.Browser != "Edge" || edge.Version != 126 || edge.OS != "Windows" {
+		t.Errorf("got %v", edge)
+	}
+
+	mng := NewSessionManager()
+	id, err := mng.NewSession("bob", request(chrome, "en-US"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = mng.Login(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firefox := request("Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0", "en-US")
+	if err := mng.VerifySessionWithIP(id, firefox); err != nil {
+		t.Errorf("fingerprints are off by default, got %v", err)
+	}
+	if err := mng.SetFingerprintPolicy(FingerprintReject); err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.VerifySessionWithIP(id, firefox); err != ErrFingerprintMismatch {
+		t.Errorf("different browser: got %v", err)
+	}
+	if err := mng.VerifySessionWithIP(id, request(chrome, "de-DE")); err != ErrFingerprintMismatch {
+		t.Errorf("different language: got %v", err)
+	}
+
+	//the browser updating itself is fine, but going back isn't
+	upgraded := strings.Replace(chrome, "Chrome/125.0.6422.165", "Chrome/126.0.6478.71", 1)
+	if err := mng.VerifySessionWithIP(id, request(upgraded, "en-US")); err != nil {
+		t.Errorf("upgraded browser: got %v", err)
+	}
+	if err := mng.VerifySessionWithIP(id, request(chrome, "en-US")); err != ErrFingerprintMismatch {
+		t.Errorf("downgraded browser: got %v", err)
+	}
+
+	mng.SetFingerprintPolicy(FingerprintReauth)
+	if err := mng.VerifySessionWithIP(id, firefox); err != ErrReauthRequired {
+		t.Errorf("reauth: got %v", err)
+	}
+	if err := mng.VerifySession(id); err == nil {
+		t.Error("session should be logged out after a reauth mismatch")
+	}
+	id, err = mng.Login(nil, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.VerifySessionWithIP(id, firefox); err != nil {
+		t.Errorf("the device that logged in again owns the session, got %v", err)
+	}
+	if err := mng.SetFingerprintPolicy(42); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+}
+
+func TestIPResolver(t *testing.T) {
+	mng := NewSessionManager()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	id, err := mng.NewSession("bob", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := mng.GetSession(id)
+	if sess.ipAddress["192.0.2.1"] != true || len(sess.ipAddress) != 1 {
+		t.Errorf("headers from an untrusted proxy should be ignored, got %v", sess.ipAddress)
+	}
+
+	res, err := clientip.NewResolver(clientip.HeaderXForwardedFor, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mng.SetIPResolver(res)
+	id, err = mng.NewSession("bob", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, _ = mng.GetSession(id)
+	if sess.ipAddress["198.51.100.7"] != true || len(sess.ipAddress) != 1 {
+		t.Errorf("expected the client behind the proxy, got %v", sess.ipAddress)
+	}
+}
+
+func TestIPPolicies(t *testing.T) {
+	from := func(addr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+	mng := NewSessionManager()
+	id, err := mng.NewSession("bob", from("192.0.2.1:1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.ValidateIP(from("192.0.2.1:5678"), id); err != nil {
+		t.Errorf("same address, different port: got %v", err)
+	}
+	//a new address is turned away, every time, instead of being added to the session
+	for i := 0; i < 2; i++ {
+		if err := mng.ValidateIP(from("192.0.2.2:1234"), id); err == nil {
+			t.Error("accepted an address the session was never bound to")
+		}
+	}
+
+	mng.SetIPBinding(24, 64)
+	id, err = mng.NewSession("bob", from("192.0.2.1:1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.ValidateIP(from("192.0.2.200:1"), id); err != nil {
+		t.Errorf("same /24: got %v", err)
+	}
+	if err := mng.ValidateIP(from("192.0.3.1:1"), id); err == nil {
+		t.Error("accepted an address outside the /24")
+	}
+	id6, err := mng.NewSession("bob", from("[2001:db8:1:2::5]:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.ValidateIP(from("[2001:db8:1:2:aaaa::1]:443"), id6); err != nil {
+		t.Errorf("same /64: got %v", err)
+	}
+	if err := mng.ValidateIP(from("[2001:db8:1:3::5]:443"), id6); err == nil {
+		t.Error("accepted an address outside the /64")
+	}
+
+	//the most specific entry wins
+	if err := mng.BlockIP(id, "192.0.2.7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.AllowIP(id, "198.51.100.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	for addr, ok := range map[string]bool{"192.0.2.7:1": false, "192.0.2.8:1": true, "198.51.100.3:1": true} {
+		if err := mng.ValidateIP(from(addr), id); (err == nil) != ok {
+			t.Errorf("%v: got %v", addr, err)
+		}
+	}
+	if err := mng.AllowIP(id, "not an address"); err == nil {
+		t.Error("allowed something that isn't an address")
+	}
+
+	//the blocklist beats everything, and stops new sessions too
+	if err := mng.BlockNetwork("192.0.2.0/28"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.ValidateIP(from("192.0.2.8:1"), id); err == nil {
+		t.Error("accepted an address on the blocklist")
+	}
+	if _, err := mng.NewSession("eve", from("192.0.2.3:1")); err == nil {
+		t.Error("started a session from an address on the blocklist")
+	}
+	//a request with no usable address can't start a session it could never verify
+	if _, err := mng.NewSession("eve", from("not-an-address")); err != ErrUnknownIP {
+		t.Errorf("session from an unknown address: got %v", err)
+	}
+	if list := mng.Blocklist(); len(list) != 1 || list[0] != "192.0.2.0/28" {
+		t.Errorf("got %v", list)
+	}
+	mng.UnblockNetwork("192.0.2.0/28")
+	if err := mng.ValidateIP(from("192.0.2.8:1"), id); err != nil {
+		t.Errorf("after unblocking: got %v", err)
+	}
+	if err := mng.SetIPBinding(0, 64); err == nil {
+		t.Error("accepted a binding of 0 bits")
+	}
+}
+
+func TestPasswordHashing(t *testing.T) {
+	mng := NewSessionManager()
+
+	//the default is argon2id, in PHC format
+	hash, err := mng.Hash("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(string(hash), "$argon2id$v=19$m=19456,t=2,p=1$") != true {
+		t.Errorf("got %s", hash)
+	}
+	if err := mng.CheckPassword("hunter2", hash); err != nil {
+		t.Error(err)
+	}
+	if err := mng.CheckPassword("hunter3", hash); err != ErrPasswordMismatch {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if again, _ := mng.Hash("hunter2"); string(again) == string(hash) {
+		t.Error("two hashes of the same password came out the same, so they aren't salted")
+	}
+
+	//hashes from every hasher still check out whatever the manager uses now
+	argon, _ := NewArgon2idHasher(1, 64, 1)
+	scr, _ := NewScryptHasher(4, 8, 1)
+	bc, _ := NewBcryptHasher(4)
+	pb, _ := NewPBKDF2Hasher(10)
+	hashes := make(map[string][]byte)
+	for _, h := range []PasswordHasher{argon, scr, bc, pb} {
+		mng.SetPasswordHasher(h)
+		hash, err := mng.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%v: %v", h.ID(), err)
+		}
+		hashes[h.ID()] = hash
+	}
+	for _, name := range []string{HasherArgon2id, HasherScrypt, HasherBcrypt, HasherPBKDF2} {
+		if err := mng.SetEncryptionType(name); err != nil {
+			t.Fatal(err)
+		}
+		for id, hash := range hashes {
+			if err := mng.CheckPassword("correct horse", hash); err != nil {
+				t.Errorf("%v hash under %v: %v", id, name, err)
+			}
+			if err := mng.CheckPassword("battery staple", hash); err != ErrPasswordMismatch {
+				t.Errorf("%v hash under %v with the wrong password: got %v", id, name, err)
+			}
+		}
+	}
+	if strings.HasPrefix(string(hashes[HasherScrypt]), "$scrypt$ln=4,r=8,p=1$") != true {
+		t.Errorf("got %s", hashes[HasherScrypt])
+	}
+	if strings.HasPrefix(string(hashes[HasherPBKDF2]), "$pbkdf2-sha256$i=10$") != true {
+		t.Errorf("got %s", hashes[HasherPBKDF2])
+	}
+
+	//things that aren't hashes, or are broken ones, are errors rather than mismatches
+	for _, bad := range []string{"", "md5", "$md5$abc", "$argon2id$v=19$m=64,t=1$c2FsdA$aGFzaA", "$scrypt$ln=4,r=8,p=1$c2FsdA$"} {
+		if err := mng.CheckPassword("x", []byte(bad)); err == nil || err == ErrPasswordMismatch {
+			t.Errorf("%q: got %v", bad, err)
+		}
+	}
+	if err := mng.SetEncryptionType("md5"); err == nil {
+		t.Error("md5 is still allowed")
+	}
+	if _, err := NewBcryptHasher(2); err == nil {
+		t.Error("accepted a bcrypt cost of 2")
+	}
+
+	//a stored hash can't ask for more work than the limits, or sneak past them by overflowing
+	for _, greedy := range []string{
+		"$argon2id$v=19$m=4294967304,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=4294967297,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=8388608,t=1,p=1$c2FsdA$aGFzaA",
+		"$scrypt$ln=30,r=8,p=1$c2FsdA$aGFzaA",
+		"$scrypt$ln=4,r=9223372036854775807,p=1$c2FsdA$aGFzaA",
+		"$scrypt$ln=4,r=8,p=1000000$c2FsdA$aGFzaA",
+		"$pbkdf2-sha256$i=1000000000$c2FsdA$aGFzaA",
+	} {
+		if err := mng.CheckPassword("x", []byte(greedy)); err == nil || err == ErrPasswordMismatch {
+			t.Errorf("%q: got %v", greedy, err)
+		}
+	}
+	if _, err := NewArgon2idHasher(1, 1<<23, 1); err == nil {
+		t.Error("accepted 8 GiB for argon2id")
+	}
+	if _, err := NewScryptHasher(30, 8, 1); err == nil {
+		t.Error("accepted 128 GiB for scrypt")
+	}
+	if _, err := NewPBKDF2Hasher(1 << 30); err == nil {
+		t.Error("accepted 2^30 PBKDF2 iterations")
+	}
+}
+
+func TestStatelessLockout(t *testing.T) {
+	k, err := NewKeyring("edge", []byte(strings.Repeat("e", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewSessionManager()
+	a.SetKeyring(k)
+	a.SetStateless(true)
+	a.SetMaxAttempts(3)
+	id, err := a.NewSession("user", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := a.SetSessionCookie(w, id); err != nil {
+		t.Fatal(err)
+	}
+	r := requestWithCookies(w)
+
+	//replaying the original cookie before every attempt mustn't reset the count
+	var lockErr error
+	for i := 0; i < 10; i++ {
+		if _, err := a.ReadSessionCookie(r); err != nil {
+			if err != ErrSessionRevoked || lockErr == nil {
+				t.Fatalf("attempt %v: got %v", i, err)
+			}
+			continue
+		}
+		sess, err := a.GetSession(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.CountUp(sess); err != nil && lockErr == nil {
+			lockErr = err
+		}
+	}
+	if lockErr == nil {
+		t.Fatal("never locked out")
+	}
+	sess, err := a.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.locked != true || sess.counter.attempts != 3 {
+		t.Errorf("got attempts=%v locked=%v", sess.counter.attempts, sess.locked)
+	}
+
+	//the cookie still says it isn't locked, so it's turned away until the lockout is up
+	if _, err := a.ReadSessionCookie(r); err != ErrSessionRevoked {
+		t.Errorf("cookie during the lockout: got %v", err)
+	}
+	a.unlock(id)
+	a.revokedMux.Lock()
+	a.revoked[id] = time.Now().Add(-time.Second)
+	a.revokedMux.Unlock()
+	if _, err := a.ReadSessionCookie(r); err != nil {
+		t.Errorf("cookie after the lockout: got %v", err)
+	}
+	if sess, _ := a.GetSession(id); sess.locked || sess.counter.attempts != 0 {
+		t.Errorf("after unlocking: got attempts=%v locked=%v", sess.counter.attempts, sess.locked)
+	}
+}
+
+//crashFileStore closes a file store's journal without taking a snapshot, like the process died
+func crashFileStore(s *fileStore) {
+	s.mux.Lock()
+	s.journal.Close()
+	s.journal = nil
+	s.mux.Unlock()
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Round(0)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Put(&SessionRecord{ID: id, Username: "bob", Created: now, LastSeen: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(time.Minute)
+	if err := store.Touch("a", later); err != nil {
+		t.Fatal(err)
+	}
+	crashFileStore(store)
+
+	//a torn write at the end of the journal is thrown away, along with anything after it
+	journal := filepath.Join(dir, journalFileName)
+	info, err := os.Stat(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := info.Size()
+	torn, _ := encodeJournalLine(&journalEntry{Op: "delete", ID: "a"})
+	f, err := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(torn[:len(torn)/2])
+	f.Close()
+
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(journal); info.Size() != good {
+		t.Errorf("journal is %v bytes after replay, want %v", info.Size(), good)
+	}
+	if rec, err := store.Get("a"); err != nil || rec.LastSeen.Equal(later) != true {
+		t.Errorf("a: got %+v, %v", rec, err)
+	}
+	if _, err := store.Get("b"); err != nil {
+		t.Errorf("b: %v", err)
+	}
+	if _, err := store.Get("c"); err != ErrSessionNotFound {
+		t.Errorf("c was deleted, got %v", err)
+	}
+
+	//a line with a bad checksum counts as damaged too, even with a newline on the end
+	if err := store.Put(&SessionRecord{ID: "d", Created: now, LastSeen: now}); err != nil {
+		t.Fatal(err)
+	}
+	crashFileStore(store)
+	f, _ = os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte("0 {\"op\":\"delete\",\"id\":\"b\"}\n"))
+	f.Close()
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("b"); err != nil {
+		t.Errorf("a damaged entry was applied: %v", err)
+	}
+	if _, err := store.Get("d"); err != nil {
+		t.Errorf("d: %v", err)
+	}
+
+	//once enough entries are written, they're compacted into a snapshot and the journal starts over
+	if err := store.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	store.SetSnapshotEvery(3)
+	for _, id := range []string{"e", "f"} {
+		if err := store.Put(&SessionRecord{ID: id, Created: now, LastSeen: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, _ := os.Stat(journal); info.Size() == 0 {
+		t.Error("journal is empty before the snapshot")
+	}
+	if err := store.Delete("e"); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(journal); info.Size() != 0 {
+		t.Errorf("journal wasn't emptied by the snapshot, it's %v bytes", info.Size())
+	}
+	if err := store.Put(&SessionRecord{ID: "h", Created: now, LastSeen: now}); err != nil {
+		t.Fatal(err)
+	}
+	crashFileStore(store)
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, _ := store.List()
+	ids := make(map[string]bool)
+	for _, rec := range recs {
+		ids[rec.ID] = true
+	}
+	if len(ids) != 5 || ids["a"] != true || ids["b"] != true || ids["d"] != true || ids["f"] != true || ids["h"] != true {
+		t.Errorf("after snapshot and replay: got %v", ids)
+	}
+
+	//a snapshot that fails doesn't turn a write that made it into the journal into an error
+	store.SetSnapshotEvery(1)
+	snapshot := filepath.Join(dir, snapshotFileName)
+	os.Remove(snapshot)
+	os.MkdirAll(filepath.Join(snapshot, "in the way"), 0700)
+	if err := store.Put(&SessionRecord{ID: "g", Created: now, LastSeen: now}); err != nil {
+		t.Errorf("put that was journaled: got %v", err)
+	}
+	if _, err := store.Get("g"); err != nil {
+		t.Error(err)
+	}
+	os.RemoveAll(snapshot)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.Get("g"); err != nil {
+		t.Errorf("g after reopening: %v", err)
+	}
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mng := NewSessionManager()
+	mng.SetMaxAttempts(2)
+	mng.SetLockoutTime(60)
+	if err := mng.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.AllowIP(id, "198.51.100.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.BlockIP(id, "198.51.100.7"); err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := mng.GetSession(id)
+	mng.CountUp(sess)
+	if err := mng.CountUp(sess); err == nil {
+		t.Fatal("never locked out")
+	}
+	crashFileStore(store)
+
+	//a new process picks up the lockout where the old one left off, timer and all
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	other := NewSessionManager()
+	if err := other.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	sess, err = other.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.locked != true || sess.counter.attempts != 2 || sess.lockedUntil.IsZero() {
+		t.Errorf("got locked=%v attempts=%v until=%v", sess.locked, sess.counter.attempts, sess.lockedUntil)
+	}
+	other.lockoutMux.Lock()
+	_, timer := other.lockouts[id]
+	other.lockoutMux.Unlock()
+	if timer != true {
+		t.Error("lockout timer wasn't restarted")
+	}
+	want := map[string]bool{"192.0.2.1": true, "198.51.100.0/24": true, "198.51.100.7": false}
+	if len(sess.ipAddress) != len(want) {
+		t.Errorf("got %v", sess.ipAddress)
+	}
+	for ip, ok := range want {
+		if allowed, found := sess.ipAddress[ip]; found != true || allowed != ok {
+			t.Errorf("%v: got %v, %v", ip, allowed, found)
+		}
+	}
+}
+
+func TestMarshalSessionManager(t *testing.T) {
+	mng := NewSessionManager()
+	mng.SetSessionLength(600)
+	mng.SetIdleTimeout(120)
+	mng.SetMaxAttempts(2)
+	mng.SetLockoutTime(90)
+	mng.SetEncryptionType(HasherScrypt)
+	if err := mng.BlockNetwork("203.0.113.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil), "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mng.BlockIP(id, "198.51.100.7"); err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := mng.GetSession(id)
+	mng.CountUp(sess)
+	mng.CountUp(sess)
+
+	data, err := mng.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "manager.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSessionManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.id != mng.id || loaded.sessionLength != 600 || loaded.idleTimeout != 120 || loaded.maxUserLoginAttempts != 2 ||
+		loaded.userLockoutTime != 90 || loaded.encryptionType != HasherScrypt || loaded.hashStrength != mng.hashStrength {
+		t.Errorf("settings didn't survive: %+v", loaded)
+	}
+	if list := loaded.Blocklist(); len(list) != 1 || list[0] != "203.0.113.0/24" {
+		t.Errorf("blocklist: got %v", list)
+	}
+	got, err := loaded.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.username != "bob" || got.role != "admin" || got.locked != true || got.counter.attempts != 2 ||
+		got.ipAddress["192.0.2.1"] != true || got.ipAddress["198.51.100.7"] != false || len(got.ipAddress) != 2 {
+		t.Errorf("session didn't survive: %+v", got)
+	}
+	loaded.lockoutMux.Lock()
+	_, timer := loaded.lockouts[id]
+	loaded.lockoutMux.Unlock()
+	if timer != true {
+		t.Error("lockout timer wasn't restarted")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	mng := NewSessionManager()
+	if mng.idleTimeout != 0 {
+		t.Errorf("sessions idle out by default after %v seconds", mng.idleTimeout)
+	}
+	newLive := func() string {
+		id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, err = mng.Login(nil, id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	//age moves a session's times back, like it was created and last seen that long ago
+	age := func(id string, created, lastSeen time.Duration) {
+		rec, err := mng.getStore().Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Created = time.Now().Add(-created)
+		rec.LastSeen = time.Now().Add(-lastSeen)
+		mng.getStore().Put(rec)
+	}
+
+	//the session length is absolute, so being used recently doesn't save a session
+	mng.SetSessionLength(60)
+	id := newLive()
+	age(id, 61*time.Second, 0)
+	if err := mng.VerifySession(id); err == nil {
+		t.Error("session outlived its length")
+	}
+	if _, err := mng.getStore().Get(id); err != ErrSessionNotFound {
+		t.Errorf("expired session wasn't deleted: %v", err)
+	}
+
+	//the idle timeout slides, so every VerifySession pushes it back
+	mng.SetSessionLength(0)
+	mng.SetIdleTimeout(60)
+	id = newLive()
+	age(id, time.Hour, 50*time.Second)
+	if err := mng.VerifySession(id); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := mng.getStore().Get(id); time.Since(rec.LastSeen) > time.Second {
+		t.Errorf("VerifySession didn't reset the idle timer, last seen %v", rec.LastSeen)
+	}
+	age(id, time.Hour, 61*time.Second)
+	if _, err := mng.GetSession(id); err == nil {
+		t.Error("session outlived its idle timeout")
+	}
+
+	//the janitor deletes expired sessions nobody comes back for, and leaves the rest alone
+	if err := mng.SetSweepInterval(0); err == nil {
+		t.Error("accepted a sweep interval of 0")
+	}
+	stale, fresh := newLive(), newLive()
+	age(stale, time.Hour, time.Hour)
+	if err := mng.SetSweepInterval(1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := mng.getStore().Get(stale); err == ErrSessionNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the janitor never swept the expired session")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := mng.getStore().Get(fresh); err != nil {
+		t.Errorf("the janitor swept a live session: %v", err)
+	}
+
+	//and it stops when the manager is closed
+	if err := mng.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-mng.doneChan:
+	case <-time.After(time.Second):
+		t.Error("the janitor kept running after Close")
+	}
+}
+
+//closerStore counts how many times the store it wraps was closed
+type closerStore struct {
+	SessionStore
+	closes int32
+}
+
+func (s *closerStore) Close() error {
+	atomic.AddInt32(&s.closes, 1)
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	mng := NewSessionManager()
+	store := &closerStore{SessionStore: NewMemoryStore()}
+	mng.SetStore(store)
+	mng.SetMaxAttempts(1)
+	id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := mng.GetSession(id)
+	mng.CountUp(sess)
+
+	//a call that's still underway holds Close up, and a Close that runs out of time leaves the
+	//store open
+	if err := mng.enter(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := mng.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+	if atomic.LoadInt32(&store.closes) != 0 {
+		t.Error("store was closed before the calls drained")
+	}
+	mng.lockoutMux.Lock()
+	timers := len(mng.lockouts)
+	mng.lockoutMux.Unlock()
+	if timers != 0 {
+		t.Errorf("%v lockout timers still running", timers)
+	}
+
+	//nothing new gets in while it's closing
+	if err := mng.VerifySession(id); err != ErrManagerClosed {
+		t.Errorf("VerifySession: got %v", err)
+	}
+	if _, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil)); err != ErrManagerClosed {
+		t.Errorf("NewSession: got %v", err)
+	}
+	//the cookie helpers that don't touch sessions are shut out too
+	r := withConsent(httptest.NewRequest("GET", "/", nil), ConsentPreferences, ConsentAnalytics)
+	if err := mng.SetPreferences(httptest.NewRecorder(), r, "dark"); err != ErrManagerClosed {
+		t.Errorf("SetPreferences: got %v", err)
+	}
+	var pref string
+	if err := mng.GetPreferences(r, &pref); err != ErrManagerClosed {
+		t.Errorf("GetPreferences: got %v", err)
+	}
+	if _, err := mng.TrackVisit(httptest.NewRecorder(), r); err != ErrManagerClosed {
+		t.Errorf("TrackVisit: got %v", err)
+	}
+	if _, err := mng.GetVisitor(r); err != ErrManagerClosed {
+		t.Errorf("GetVisitor: got %v", err)
+	}
+	if _, err := mng.SetConsent(httptest.NewRecorder(), r, map[string]bool{ConsentAnalytics: true}); err != ErrManagerClosed {
+		t.Errorf("SetConsent: got %v", err)
+	}
+	if _, err := mng.Encrypt("state", []byte("hi")); err != ErrManagerClosed {
+		t.Errorf("Encrypt: got %v", err)
+	}
+	if _, err := mng.Decrypt("state", "k.abc"); err != ErrManagerClosed {
+		t.Errorf("Decrypt: got %v", err)
+	}
+	if err := mng.SetEncryptedCookie(httptest.NewRecorder(), r, "state", []byte("hi")); err != ErrManagerClosed {
+		t.Errorf("SetEncryptedCookie: got %v", err)
+	}
+	if _, err := mng.ReadEncryptedCookie(r, "state"); err != ErrManagerClosed {
+		t.Errorf("ReadEncryptedCookie: got %v", err)
+	}
+	recorded := false
+	w := httptest.NewRecorder()
+	mng.BeaconHandler(func(b *Beacon) { recorded = true }).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(`{}`)))
+	if w.Code != http.StatusServiceUnavailable || recorded {
+		t.Errorf("BeaconHandler: got %v, recorded %v", w.Code, recorded)
+	}
+	reached := false
+	w = httptest.NewRecorder()
+	mng.ConsentMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true })).ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || reached {
+		t.Errorf("ConsentMiddleware: got %v, reached the handler %v", w.Code, reached)
+	}
+
+	//once the call finishes, trying again closes the store, exactly once
+	mng.leave()
+	if err := mng.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&store.closes) != 1 {
+		t.Errorf("store was closed %v times", store.closes)
+	}
+	if err := mng.Close(context.Background()); err != ErrManagerClosed {
+		t.Errorf("closing twice: got %v", err)
+	}
+	if atomic.LoadInt32(&store.closes) != 1 {
+		t.Errorf("store was closed %v times", store.closes)
+	}
+
+	//the lock on the session is still in the store for the next manager to pick up
+	if rec, err := store.Get(id); err != nil || rec.Locked != true {
+		t.Errorf("got %+v, %v", rec, err)
+	}
+}
+
+//testSessionStore checks that a store keeps the SessionStore contract. Every store should pass
+//it, so a new store only needs to be added to TestSessionStores
+func testSessionStore(t *testing.T, store SessionStore) {
+	t.Helper()
+	now := time.Now().Truncate(time.Second)
+	if _, err := store.Get("missing"); err != ErrSessionNotFound {
+		t.Errorf("Get on a missing ID: got %v", err)
+	}
+	if err := store.Touch("missing", now); err != ErrSessionNotFound {
+		t.Errorf("Touch on a missing ID: got %v", err)
+	}
+	if err := store.Delete("missing"); err != nil {
+		t.Errorf("Delete on a missing ID: got %v", err)
+	}
+
+	rec := &SessionRecord{
+		ID:        "a",
+		Username:  "alice",
+		Role:      "admin",
+		IPAddress: map[string]bool{"192.0.2.1": true, "192.0.2.2": false},
+		Attempts:  2,
+		Created:   now,
+		LastSeen:  now,
+		Data:      map[string][]byte{"cart": []byte(`["apple"]`)},
+	}
+	if err := store.Put(rec); err != nil {
+		t.Fatal(err)
+	}
+	//changing the record after it's put, or a copy that came back from Get, doesn't change the store
+	rec.IPAddress["192.0.2.3"] = true
+	rec.Data["cart"][0] = 'X'
+	got, err := store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "alice" || got.Role != "admin" || got.Attempts != 2 || got.Created.Equal(now) != true ||
+		len(got.IPAddress) != 2 || got.IPAddress["192.0.2.2"] != false || string(got.Data["cart"]) != `["apple"]` {
+		t.Errorf("got %+v", got)
+	}
+	got.IPAddress["192.0.2.4"] = true
+	got.Data["cart"] = []byte("changed")
+	got.Role = "changed"
+	if again, _ := store.Get("a"); len(again.IPAddress) != 2 || string(again.Data["cart"]) != `["apple"]` || again.Role != "admin" {
+		t.Errorf("changing a copy changed the store: %+v", again)
+	}
+
+	//Put overwrites, and Touch only moves LastSeen
+	rec = &SessionRecord{ID: "a", Username: "alice", Role: "user", Created: now, LastSeen: now}
+	if err := store.Put(rec); err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(time.Minute)
+	if err := store.Touch("a", later); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get("a"); got.Role != "user" || got.LastSeen.Equal(later) != true || got.Created.Equal(now) != true {
+		t.Errorf("after Put and Touch: got %+v", got)
+	}
+
+	for _, r := range []*SessionRecord{
+		{ID: "b", Username: "alice", Created: now, LastSeen: now},
+		{ID: "c", Username: "bob", Created: now, LastSeen: now},
+	} {
+		if err := store.Put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, err := store.List()
+	if err != nil || len(recs) != 3 {
+		t.Errorf("List: got %v records, %v", len(recs), err)
+	}
+	if lister, ok := store.(UserLister); ok {
+		if recs, err := lister.ListByUser("alice"); err != nil || len(recs) != 2 {
+			t.Errorf("ListByUser: got %v records, %v", len(recs), err)
+		}
+	}
+	if err := store.DeleteByUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]error{"a": ErrSessionNotFound, "b": ErrSessionNotFound, "c": nil} {
+		if _, err := store.Get(id); err != want {
+			t.Errorf("%v after DeleteByUser: got %v", id, err)
+		}
+	}
+	if err := store.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("c"); err != ErrSessionNotFound {
+		t.Errorf("after Delete: got %v", err)
+	}
+}
+
+func TestSessionStores(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testSessionStore(t, NewMemoryStore())
+	})
+	t.Run("file", func(t *testing.T) {
+		store, err := NewFileStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		testSessionStore(t, store)
+	})
+	t.Run("sql", func(t *testing.T) {
+		testSessionStore(t, newTestSQLStore(t))
+	})
+	t.Run("redis", func(t *testing.T) {
+		store, err := NewRedisStore(newRESPServer(t).addr(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		testSessionStore(t, store)
+	})
+}
+
+func TestStoreAttempts(t *testing.T) {
+	t.Run("sql", func(t *testing.T) {
+		testStoreAttempts(t, newTestSQLStore(t))
+	})
+	t.Run("redis", func(t *testing.T) {
+		store, err := NewRedisStore(newRESPServer(t).addr(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		testStoreAttempts(t, store)
+	})
+}
+
+//testStoreAttempts checks that a store that counts attempts itself doesn't let a Put from
+//another server overwrite the count
+func testStoreAttempts(t *testing.T, store SessionStore) {
+	mng := NewSessionManager()
+	mng.SetMaxAttempts(3)
+	mng.SetStore(store)
+	id, err := mng.NewSession("bob", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := store.Get(id) //what another server read before any attempts were counted
+
+	sess, _ := mng.GetSession(id)
+	mng.CountUp(sess)
+	mng.CountUp(sess)
+
+	//the other server writes something unrelated back, and mustn't wipe out the count
+	stale.Flashes = []Flash{{Level: FlashInfo, Message: "hi"}}
+	if err := store.Put(stale); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := store.Get(id); rec.Attempts != 2 {
+		t.Errorf("a Put reset the attempts to %v", rec.Attempts)
+	}
+	sess, _ = mng.GetSession(id)
+	if err := mng.CountUp(sess); err == nil {
+		t.Error("third attempt didn't lock the session")
+	}
+
+	//ending the lockout is the one thing that resets the count
+	mng.unlock(id)
+	if rec, _ := store.Get(id); rec.Attempts != 0 || rec.Locked {
+		t.Errorf("after unlocking: got attempts=%v locked=%v", rec.Attempts, rec.Locked)
+	}
+}
+
+func TestRedisStoreLastSeen(t *testing.T) {
+	srv := newRESPServer(t)
+	store, err := NewRedisStore(srv.addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	now := time.Now().Round(0)
+	if err := store.Put(&SessionRecord{ID: "a", Username: "alice", Role: "user", Created: now, LastSeen: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Touch leaves the session itself alone, so it can't write back over another server's change
+	srv.mux.Lock()
+	before := srv.strings[store.sessionKey("a")]
+	srv.mux.Unlock()
+	later := now.Add(time.Minute)
+	if err := store.Touch("a", later); err != nil {
+		t.Fatal(err)
+	}
+	srv.mux.Lock()
+	after := srv.strings[store.sessionKey("a")]
+	srv.mux.Unlock()
+	if before != after {
+		t.Error("Touch rewrote the session")
+	}
+	//and a Put from a server that read the session before the Touch doesn't move LastSeen back
+	if err := store.Put(&SessionRecord{ID: "a", Username: "alice", Role: "admin", Created: now, LastSeen: now}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := store.Get("a"); rec.Role != "admin" || rec.LastSeen.Equal(later) != true {
+		t.Errorf("got role %q, last seen %v", rec.Role, rec.LastSeen)
+	}
+	if err := store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Touch("a", later); err != ErrSessionNotFound {
+		t.Errorf("Touch on a deleted session: got %v", err)
+	}
+	srv.mux.Lock()
+	_, orphan := srv.strings[store.lastSeenKey("a")]
+	srv.mux.Unlock()
+	if orphan {
+		t.Error("Touch left a last seen key behind for a session that isn't there")
+	}
+
+	//with no session length, the idle timeout decides the TTL, and Touch keeps a session alive
+	mng := NewSessionManager()
+	mng.SetStore(store)
+	mng.SetIdleTimeout(30)
+	if ttl := store.getTTL(); ttl != 30*time.Second {
+		t.Errorf("TTL from the idle timeout: got %v", ttl)
+	}
+	mng.SetSessionLength(10)
+	if ttl := store.getTTL(); ttl != 10*time.Second {
+		t.Errorf("TTL from the shorter session length: got %v", ttl)
+	}
+	if err := store.Put(&SessionRecord{ID: "b", Username: "bob", Created: now, LastSeen: now}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		srv.advance(5 * time.Second)
+		if err := store.Touch("b", time.Now()); err != nil {
+			t.Fatalf("session expired while it was being used: %v", err)
+		}
+	}
+	srv.advance(15 * time.Second)
+	if _, err := store.Get("b"); err != ErrSessionNotFound {
+		t.Errorf("idle session didn't expire: %v", err)
+	}
+
+	//the settings can change while the store is busy
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			mng.SetSessionLength(i + 1)
+			store.SetKeyPrefix("biscuit:")
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		store.Put(&SessionRecord{ID: "c", Username: "carol", Created: now, LastSeen: now})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,128 @@
+package biscuit
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//this file is for values too big to fit in one cookie. They get split across name.0, name.1 and
+//so on, and the cookie called name holds a header saying how many chunks there are and a hash of
+//the whole value:
+//
+//	name=chunks:3:<base64url sha256>
+//
+//The hash makes sure the chunks that come back all belong to the same value, since a browser
+//can lose some of them, or hang on to chunks from an older, longer value
+
+var chunkHeaderPrefix = "chunks:"
+
+var maxChunks int = 16 //browsers only keep about 50 cookies per domain, so don't use them all up
+
+//ErrInvalidChunks is returned when a chunked cookie's chunks are missing or don't match its header
+var ErrInvalidChunks = errors.New("Error: cookie chunks are missing or don't match")
+
+//chunkName is the name of chunk i of a cookie
+func chunkName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
+
+//chunkHash hashes a whole chunked value for its header
+func chunkHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//parseChunkHeader returns the number of chunks and the hash in a chunk header. ok is false if
+//the value isn't a header, which means it's a normal, unchunked value
+func parseChunkHeader(value string) (n int, hash string, ok bool) {
+	if strings.HasPrefix(value, chunkHeaderPrefix) != true {
+		return 0, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, chunkHeaderPrefix), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 || n > maxChunks {
+		return 0, "", false
+	}
+	return n, parts[1], true
+}
+
+//writeChunked writes c, splitting its value into chunks if it's too big for one cookie. r is the
+//request being answered, and can be nil. If it carries chunks the new value doesn't need, like
+//when the value shrinks, they're deleted
+func (mng *sessionManager) writeChunked(w http.ResponseWriter, r *http.Request, c *http.Cookie) error {
+	value := c.Value
+	var chunks []string
+	if len(c.Name)+len(value)+1 > maxCookieSize {
+		size := maxCookieSize - len(chunkName(c.Name, maxChunks)) - 1
+		for len(value) > size {
+			chunks = append(chunks, value[:size])
+			value = value[size:]
+		}
+		chunks = append(chunks, value)
+		if len(chunks) > maxChunks {
+			return ErrCookieTooLarge
+		}
+		for i, chunk := range chunks {
+			cc := *c
+			cc.Name = chunkName(c.Name, i)
+			cc.Value = chunk
+			if err := mng.writeCookie(w, &cc); err != nil {
+				return err
+			}
+		}
+		c.Value = fmt.Sprintf("%s%d:%s", chunkHeaderPrefix, len(chunks), chunkHash(c.Value))
+	}
+	if err := mng.writeCookie(w, c); err != nil {
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	for _, old := range r.Cookies() {
+		if strings.HasPrefix(old.Name, c.Name+".") != true {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(old.Name, c.Name+"."))
+		if err != nil || i < len(chunks) {
+			continue
+		}
+		if err := mng.expireCookie(w, &http.Cookie{Name: old.Name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//readChunked finds the cookie with the given name, prefix and all, on a request. If it's chunked,
+//the chunks are put back together, and the cookie comes back with the whole value
+func (mng *sessionManager) readChunked(r *http.Request, name string) (*http.Cookie, error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+	n, hash, ok := parseChunkHeader(c.Value)
+	if ok != true {
+		return c, nil
+	}
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		chunk, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			return nil, ErrInvalidChunks
+		}
+		b.WriteString(chunk.Value)
+	}
+	if chunkHash(b.String()) != hash {
+		return nil, ErrInvalidChunks
+	}
+	c.Value = b.String()
+	return c, nil
+}
@@ -0,0 +1,178 @@
+package biscuit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//this file is for the consent cookie, which remembers which kinds of cookies the user has said
+//yes to. Everything but the strictly necessary cookies starts out switched off, and stays off
+//until the user turns it on, which is what the GDPR asks for. When the cookie policy changes,
+//bump the policy version, and everyone's old answers stop counting until they answer again
+
+//consent categories
+const (
+	ConsentNecessary   = "necessary" //session and consent cookies. Always allowed
+	ConsentPreferences = "preferences"
+	ConsentAnalytics   = "analytics" //the performance cookie
+	ConsentMarketing   = "marketing" //biscuit doesn't set any, but your app can check for it
+)
+
+var consentCategories = map[string]bool{ConsentNecessary: true, ConsentPreferences: true, ConsentAnalytics: true, ConsentMarketing: true}
+
+var defaultConsentMaxAge int = 60 * 60 * 24 * 180 //ask again after about 6 months
+
+//Consent is what the user has agreed to
+type Consent struct {
+	Categories map[string]bool `json:"categories"`
+	Version    int             `json:"version"` //the policy version the user agreed to
+	Timestamp  time.Time       `json:"timestamp"`
+}
+
+//Allowed reports whether the user has agreed to a category of cookies
+func (c *Consent) Allowed(category string) bool {
+	if category == ConsentNecessary {
+		return true
+	}
+	return c != nil && c.Categories[category]
+}
+
+//consentKey is the context key the consent middleware stores consent under
+type consentKey struct{}
+
+//defaultConsent is the consent of someone who hasn't answered yet
+func defaultConsent() *Consent {
+	return &Consent{Categories: map[string]bool{ConsentNecessary: true}}
+}
+
+//SetConsentPolicyVersion sets the version of the cookie policy. Consent given under any other
+//version is ignored, so raising the version asks everyone again
+func (mng *sessionManager) SetConsentPolicyVersion(i int) {
+	mng.mux.Lock()
+	mng.consentVersion = i
+	mng.mux.Unlock()
+}
+
+//ConsentFromContext returns the consent the consent middleware found for a request, or the
+//default consent if the middleware didn't run
+func ConsentFromContext(ctx context.Context) *Consent {
+	if c, ok := ctx.Value(consentKey{}).(*Consent); ok {
+		return c
+	}
+	return defaultConsent()
+}
+
+//GetConsent returns the user's consent for a request. If the consent middleware ran, that's
+//what it found, otherwise the consent cookie is read. Without a valid cookie for the current
+//policy version, only necessary cookies are allowed
+func (mng *sessionManager) GetConsent(r *http.Request) *Consent {
+	if c, ok := r.Context().Value(consentKey{}).(*Consent); ok {
+		return c
+	}
+	return mng.readConsent(r)
+}
+
+//readConsent decodes the consent cookie
+func (mng *sessionManager) readConsent(r *http.Request) *Consent {
+	c, err := r.Cookie(mng.ConsentCookie())
+	if err != nil {
+		return defaultConsent()
+	}
+	value, _, err := mng.getKeyring().verify(c.Name, c.Value)
+	if err != nil {
+		return defaultConsent()
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return defaultConsent()
+	}
+	consent := &Consent{}
+	if json.Unmarshal(data, consent) != nil || consent.Categories == nil {
+		return defaultConsent()
+	}
+	mng.mux.RLock()
+	version := mng.consentVersion
+	mng.mux.RUnlock()
+	if consent.Version != version {
+		return defaultConsent()
+	}
+	consent.Categories[ConsentNecessary] = true
+	return consent
+}
+
+//SetConsent records the user's choices in the consent cookie. Any category that's left out is
+//switched off. Cookies in categories that are switched off are deleted from the browser, and if
+//the consent middleware ran, the rest of the request sees the new choices too
+func (mng *sessionManager) SetConsent(w http.ResponseWriter, r *http.Request, categories map[string]bool) (*Consent, error) {
+	if err := mng.enter(); err != nil {
+		return nil, err
+	}
+	defer mng.leave()
+	mng.mux.RLock()
+	version := mng.consentVersion
+	mng.mux.RUnlock()
+	consent := &Consent{Categories: make(map[string]bool), Version: version, Timestamp: time.Now()}
+	for category, ok := range categories {
+		if consentCategories[category] != true {
+			return nil, fmt.Errorf("Error: unknown consent category %q", category)
+		}
+		consent.Categories[category] = ok
+	}
+	consent.Categories[ConsentNecessary] = true
+	data, err := json.Marshal(consent)
+	if err != nil {
+		return nil, err
+	}
+	c := mng.newCookie(mng.names().Consent, "", defaultConsentMaxAge)
+	c.Value = mng.getKeyring().sign(c.Name, base64.RawURLEncoding.EncodeToString(data), consent.Timestamp)
+	if err := mng.writeCookie(w, c); err != nil {
+		return nil, err
+	}
+	if old, ok := r.Context().Value(consentKey{}).(*Consent); ok {
+		*old = *consent
+	}
+	return consent, mng.enforceConsent(w, r, consent)
+}
+
+//enforceConsent deletes any cookie on the request that the user hasn't agreed to
+func (mng *sessionManager) enforceConsent(w http.ResponseWriter, r *http.Request, consent *Consent) error {
+	for category, name := range map[string]string{
+		ConsentPreferences: mng.PreferenceCookie(),
+		ConsentAnalytics:   mng.PerformanceCookie(),
+	} {
+		if consent.Allowed(category) {
+			continue
+		}
+		if c, err := r.Cookie(name); err == nil {
+			if err := mng.DeleteCookie(w, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//ConsentMiddleware reads the consent cookie once per request and puts it in the request's
+//context, where GetConsent and ConsentFromContext find it. Cookies the user hasn't agreed to,
+//because they said no, or because the policy changed since they said yes, are deleted on the way.
+//Once the manager is closed, requests get a 503 instead of going through
+func (mng *sessionManager) ConsentMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := mng.enter(); err != nil {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		consent := mng.readConsent(r)
+		err := mng.enforceConsent(w, r, consent)
+		mng.leave() //not held for next, which makes its own calls, and Close shouldn't wait on the whole handler
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), consentKey{}, consent)))
+	})
+}
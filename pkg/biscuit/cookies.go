@@ -3,63 +3,308 @@ package biscuit
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
-//SetSessionCookie sets a cookie in the browser containing the user's unique session ID
-func (mng *sessionManager) SetSessionCookie(w http.ResponseWriter, id string) error { //I can't think of any errors to return, but I'm sure I need to return one
-	sess := mng.sessions[id]
-	cookie := http.Cookie{
-		Name:     sessionCookieName, //Eventually, I'd like this to be the cookie name + managerID. Same goes for other cookies. Should probably hash them too? Just something simple like sha512, so it's easy to retrieve
-		Value:    sess.cookieID,
-		MaxAge:   mng.sessionLength,
-		HttpOnly: true,
+//name prefixes a browser enforces on the cookies that carry them
+const (
+	PrefixNone   = iota
+	PrefixSecure //"__Secure-", the cookie has to be Secure
+	PrefixHost   //"__Host-", the cookie has to be Secure, have a Path of "/", and have no Domain, so it's locked to one host
+)
+
+//CookieOptions are the attributes the session manager puts on every cookie it writes
+type CookieOptions struct {
+	Secure      bool          //only send the cookie over HTTPS
+	SameSite    http.SameSite //SameSiteNoneMode turns Secure on, since browsers drop it otherwise
+	Domain      string        //leave empty to keep the cookie to the host that set it
+	Path        string
+	Partitioned bool //keep the cookie in a separate jar for each top-level site (CHIPS). Needs Secure
+	Prefix      int  //PrefixNone, PrefixSecure or PrefixHost, added to the front of every cookie name
+}
+
+//defaultCookieOptions work over plain HTTP, so that development doesn't need certificates.
+//Anything served over HTTPS should turn Secure on
+var defaultCookieOptions = CookieOptions{
+	Path:     "/",
+	SameSite: http.SameSiteLaxMode,
+}
+
+//validate returns an error if the options break any of the rules browsers hold cookies to
+func (o CookieOptions) validate() error {
+	if o.SameSite < 0 || o.SameSite > http.SameSiteNoneMode {
+		return fmt.Errorf("Error: unknown SameSite mode %v", o.SameSite)
+	}
+	if strings.ContainsAny(o.Domain, "; \t\r\n") || strings.ContainsAny(o.Path, ";\r\n") {
+		return fmt.Errorf("Error: cookie domain %q or path %q has characters that aren't allowed", o.Domain, o.Path)
+	}
+	if o.Path != "" && strings.HasPrefix(o.Path, "/") != true {
+		return fmt.Errorf("Error: cookie path %q has to start with \"/\"", o.Path)
+	}
+	if o.Partitioned && o.Secure != true {
+		return fmt.Errorf("Error: partitioned cookies have to be Secure")
+	}
+	switch o.Prefix {
+	case PrefixNone:
+	case PrefixSecure:
+		if o.Secure != true {
+			return fmt.Errorf("Error: cookies with the __Secure- prefix have to be Secure")
+		}
+	case PrefixHost:
+		if o.Secure != true || o.Domain != "" || o.Path != "/" {
+			return fmt.Errorf("Error: cookies with the __Host- prefix have to be Secure, have no Domain, and have a Path of \"/\"")
+		}
+	default:
+		return fmt.Errorf("Error: unknown cookie prefix %v", o.Prefix)
 	}
-	http.SetCookie(w, &cookie)
 	return nil
 }
 
-//SetPerformanceCookie adds a cookie to the browser that lives indefinitely
-func (mng *sessionManager) SetPerformanceCookie(w http.ResponseWriter, data []byte) {
-	cookie := http.Cookie{
-		Name:     performanceCookieName, //eventually + mng.ID
-		Value:    fmt.Sprint(data),
-		HttpOnly: true,
+//SetCookieOptions changes the attributes put on every cookie the session manager writes from
+//now on. Options that browsers would reject, like a __Host- prefix with a Domain, return an error
+//and leave the old options in place. Changing the prefix changes every cookie's name, so
+//cookies set before the change won't be found anymore
+func (mng *sessionManager) SetCookieOptions(o CookieOptions) error {
+	if o.SameSite == http.SameSiteNoneMode {
+		o.Secure = true
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+	mng.mux.Lock()
+	mng.cookieOptions = o
+	mng.mux.Unlock()
+	return nil
+}
+
+//CookieNames are the names of the cookies a session manager writes. Two apps on the same domain
+//need different names, or they'll write over each other's cookies
+type CookieNames struct {
+	Session     string
+	Preference  string
+	Performance string
+	Consent     string
+	Flash       string
+}
+
+//validCookieName reports whether a name is allowed in a cookie, which means it's a token in the
+//sense of RFC 7230: printable ASCII, with no spaces or separators
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r)
+	}) < 0
+}
+
+//SetCookieNames changes the names of the session manager's cookies. Any name left empty keeps
+//its default. Cookies set under the old names won't be found anymore, so this should be done
+//before the manager is used
+func (mng *sessionManager) SetCookieNames(n CookieNames) error {
+	if n.Session == "" {
+		n.Session = defaultSessionCookieName
+	}
+	if n.Preference == "" {
+		n.Preference = defaultPreferenceCookieName
+	}
+	if n.Performance == "" {
+		n.Performance = defaultPerformanceCookieName
+	}
+	if n.Consent == "" {
+		n.Consent = defaultConsentCookieName
+	}
+	if n.Flash == "" {
+		n.Flash = defaultFlashCookieName
+	}
+	seen := make(map[string]bool)
+	for _, name := range []string{n.Session, n.Preference, n.Performance, n.Consent, n.Flash} {
+		if validCookieName(name) != true {
+			return fmt.Errorf("Error: %q is not a valid cookie name", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Error: cookie names have to be different from each other, got %+v", n)
+		}
+		seen[name] = true
+	}
+	mng.mux.Lock()
+	mng.cookieNames = n
+	mng.mux.Unlock()
+	return nil
+}
+
+//names returns the cookie names the session manager is currently using, without their prefix
+func (mng *sessionManager) names() CookieNames {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	return mng.cookieNames
+}
+
+//cookieName returns the name a cookie goes by in the browser, with the prefix in front of it
+func (mng *sessionManager) cookieName(name string) string {
+	mng.mux.RLock()
+	prefix := mng.cookieOptions.Prefix
+	mng.mux.RUnlock()
+	switch prefix {
+	case PrefixSecure:
+		return "__Secure-" + name
+	case PrefixHost:
+		return "__Host-" + name
 	}
-	http.SetCookie(w, &cookie)
+	return name
 }
 
-//SetPreferencesCookie adds a cookie that stores user preferences in browser for JS to use.
-//For simplicity's sake, this is passed as a slice of bytes that must be decoded in browser
-func (mng *sessionManager) SetPreferencesCookie(w http.ResponseWriter, pref []byte) {
-	cookie := http.Cookie{
-		Name:     preferenceCookieName, //+mng.ID
-		Value:    fmt.Sprint(pref),
+//newCookie builds a cookie with the manager's options. name is the name without its prefix
+func (mng *sessionManager) newCookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     mng.cookieName(name),
+		Value:    value,
+		MaxAge:   maxAge,
 		HttpOnly: true,
 	}
-	http.SetCookie(w, &cookie)
+}
+
+//writeCookie is where every cookie the session manager sets goes out. It puts the manager's
+//options on the cookie, and writes the header itself, since net/http doesn't know about
+//Partitioned yet
+func (mng *sessionManager) writeCookie(w http.ResponseWriter, c *http.Cookie) error {
+	mng.mux.RLock()
+	o := mng.cookieOptions
+	mng.mux.RUnlock()
+	c.Secure = o.Secure
+	c.SameSite = o.SameSite
+	c.Domain = o.Domain
+	c.Path = o.Path
+	v := c.String()
+	if v == "" {
+		return fmt.Errorf("Error: invalid cookie name %q", c.Name)
+	}
+	if o.Partitioned {
+		v += "; Partitioned"
+	}
+	w.Header().Add("Set-Cookie", v)
+	return nil
+}
+
+//SetSessionCookie sets a cookie in the browser containing the user's unique session ID, signed
+//so that it can't be tampered with. In stateless mode the cookie holds the whole session,
+//encrypted, and split into chunks if it's too big for one cookie. Use ReadSessionCookie to get
+//the ID back out
+func (mng *sessionManager) SetSessionCookie(w http.ResponseWriter, id string) error { //I can't think of any errors to return, but I'm sure I need to return one
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	return mng.setSessionCookie(w, id)
+}
+
+//setSessionCookie does the work for SetSessionCookie
+func (mng *sessionManager) setSessionCookie(w http.ResponseWriter, id string) error {
+	sess, err := mng.getSession(id)
+	if err != nil {
+		return err
+	}
+	value, err := mng.sessionCookieValue(sess)
+	if err != nil {
+		return err
+	}
+	mng.mux.RLock()
+	maxAge := mng.sessionLength
+	mng.mux.RUnlock()
+	//a stateless session can outgrow one cookie. There's no request here to find chunks left over
+	//from a bigger session, but the header only names the chunks that belong to it, so they're
+	//ignored until they expire with the cookie
+	return mng.writeChunked(w, nil, mng.newCookie(mng.names().Session, value, maxAge))
+}
+
+//SetEncryptedCookie encrypts data and stores it in a cookie with the given name, for keeping
+//small amounts of state in the browser where the user can't read or change it. The cookie lives
+//as long as a session does. Anything too big for one cookie is split across several, which
+//ReadEncryptedCookie puts back together. r is the request being answered, so that chunks left
+//over from a bigger value can be cleaned up, and can be nil if there isn't one
+func (mng *sessionManager) SetEncryptedCookie(w http.ResponseWriter, r *http.Request, name string, data []byte) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	mng.mux.RLock()
+	maxAge := mng.sessionLength
+	mng.mux.RUnlock()
+	c := mng.newCookie(name, "", maxAge)
+	value, err := mng.encrypt(c.Name, data)
+	if err != nil {
+		return err
+	}
+	c.Value = value
+	return mng.writeChunked(w, r, c)
+}
+
+//ReadEncryptedCookie finds the cookie with the given name on a request and decrypts it
+func (mng *sessionManager) ReadEncryptedCookie(r *http.Request, name string) ([]byte, error) {
+	if err := mng.enter(); err != nil {
+		return nil, err
+	}
+	defer mng.leave()
+	c, err := mng.readChunked(r, mng.cookieName(name))
+	if err != nil {
+		return nil, err
+	}
+	return mng.decrypt(c.Name, c.Value)
 }
 
 //DeleteCookie sets a cookie to expire immediately. This is the function to be used for deleting
-//all types of cookies in biscuit
-func (mng *sessionManager) DeleteCookie(w http.ResponseWriter, c *http.Cookie) error { //see setSessionCookie
-	c.Expires = time.Now()
-	c.MaxAge = -1
-	http.SetCookie(w, c)
+//all types of cookies in biscuit. The cookie goes back out with the manager's Domain and Path,
+//since browsers only delete a cookie if those match the ones it was set with. Every chunk of a
+//chunked cookie is deleted with it: if c is the header as it comes off a request, that's the
+//chunks it names, and if c has no value, like &http.Cookie{Name: name}, it's every chunk the
+//cookie could have, since there's no telling how many it had
+func (mng *sessionManager) DeleteCookie(w http.ResponseWriter, c *http.Cookie) error {
+	n, _, _ := parseChunkHeader(c.Value)
+	if c.Value == "" {
+		n = maxChunks
+	}
+	if err := mng.expireCookie(w, c); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := mng.expireCookie(w, &http.Cookie{Name: chunkName(c.Name, i)}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-//SessionCookie returns the var sessionCookieName
-func SessionCookie() string {
-	return sessionCookieName
+//expireCookie does the work for DeleteCookie, for one cookie
+func (mng *sessionManager) expireCookie(w http.ResponseWriter, c *http.Cookie) error {
+	c.Value = ""
+	c.Expires = time.Unix(0, 0)
+	c.MaxAge = -1
+	return mng.writeCookie(w, c)
+}
+
+//SessionCookie returns the name of the session manager's session cookie, prefix and all, which
+//is what it'll be called on a request
+func (mng *sessionManager) SessionCookie() string {
+	return mng.cookieName(mng.names().Session)
+}
+
+//PreferenceCookie returns the name of the session manager's preferences cookie
+func (mng *sessionManager) PreferenceCookie() string {
+	return mng.cookieName(mng.names().Preference)
+}
+
+//PerformanceCookie returns the name of the session manager's performance cookie
+func (mng *sessionManager) PerformanceCookie() string {
+	return mng.cookieName(mng.names().Performance)
 }
 
-//PreferenceCookie returns the var prefCookieName
-func PreferenceCookie() string {
-	return preferenceCookieName
+//ConsentCookie returns the name of the session manager's consent cookie
+func (mng *sessionManager) ConsentCookie() string {
+	return mng.cookieName(mng.names().Consent)
 }
 
-//PerformanceCookie returns the var perfCookieName
-func PerformanceCookie() string {
-	return performanceCookieName
+//FlashCookie returns the name of the session manager's flash cookie
+func (mng *sessionManager) FlashCookie() string {
+	return mng.cookieName(mng.names().Flash)
 }
@@ -0,0 +1,190 @@
+package biscuit
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+//this file is for the data a program wants to keep with a session beyond its username and role,
+//like a shopping cart or the page to go back to after logging in. Values are encoded with the
+//manager's codec when they're set, so any store can keep them, and decoded again when they're
+//read. A session is only written back to the store if something in it actually changed
+
+//ErrKeyNotFound is returned when a session has no value for a key
+var ErrKeyNotFound = errors.New("Error: no value for that key in the session")
+
+//Codec turns session values into bytes and back again
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+//JSONCodec is the default codec. It's easy to read in a store, but only keeps exported fields,
+//and numbers in an interface{} come back as float64
+var JSONCodec Codec = jsonCodec{}
+
+//GobCodec keeps Go types more faithfully than JSON. Concrete types stored in interfaces have to
+//be registered with gob.Register first
+var GobCodec Codec = gobCodec{}
+
+//SetCodec changes the codec session values are encoded with. Values that were set under the old
+//codec won't decode under the new one, so pick one before storing anything
+func (mng *sessionManager) SetCodec(c Codec) {
+	mng.mux.Lock()
+	mng.codec = c
+	mng.mux.Unlock()
+}
+
+//getCodec returns the codec the manager is using
+func (mng *sessionManager) getCodec() Codec {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	return mng.codec
+}
+
+//SessionData is a session's values, as handed to the function passed to Update
+type SessionData struct {
+	codec  Codec
+	values map[string][]byte
+	dirty  bool
+}
+
+//Get decodes the value stored under key into v, which should be a pointer
+func (d *SessionData) Get(key string, v interface{}) error {
+	data, ok := d.values[key]
+	if ok != true {
+		return ErrKeyNotFound
+	}
+	return d.codec.Unmarshal(data, v)
+}
+
+//Set stores v under key. Setting a key to the value it already has doesn't count as a change
+func (d *SessionData) Set(key string, v interface{}) error {
+	data, err := d.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if old, ok := d.values[key]; ok && bytes.Equal(old, data) {
+		return nil
+	}
+	if d.values == nil {
+		d.values = make(map[string][]byte)
+	}
+	d.values[key] = data
+	d.dirty = true
+	return nil
+}
+
+//Delete removes the value stored under key, if there is one
+func (d *SessionData) Delete(key string) {
+	if _, ok := d.values[key]; ok {
+		delete(d.values, key)
+		d.dirty = true
+	}
+}
+
+//Keys returns every key that has a value, in order
+func (d *SessionData) Keys() []string {
+	keys := make([]string, 0, len(d.values))
+	for key := range d.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Update calls f with a session's values, while nothing else can change the session. If f changes
+//anything and doesn't return an error, the session is written back to the store. Otherwise the
+//store isn't touched. In stateless mode the values live in the session cookie, so changes only
+//reach the browser when the cookie is set again
+func (mng *sessionManager) Update(id string, f func(d *SessionData) error) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	return mng.update(id, f)
+}
+
+//update does the work for Update and the other data functions
+func (mng *sessionManager) update(id string, f func(d *SessionData) error) error {
+	unlock := mng.lockSession(id)
+	sess, err := mng.getSession(id)
+	if err == nil && sess.cookieID != id {
+		//the session was rotated, so it has to be locked under the ID it has now
+		unlock()
+		unlock = mng.lockSession(sess.cookieID)
+		sess, err = mng.getSession(sess.cookieID)
+	}
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	d := &SessionData{codec: mng.getCodec(), values: sess.data}
+	if err := f(d); err != nil {
+		return err
+	}
+	if d.dirty != true {
+		return nil
+	}
+	sess.data = d.values
+	return mng.save(sess)
+}
+
+//Set stores a value in a session under key
+func (mng *sessionManager) Set(id, key string, v interface{}) error {
+	return mng.Update(id, func(d *SessionData) error {
+		return d.Set(key, v)
+	})
+}
+
+//Get decodes the value a session has under key into v, which should be a pointer. It returns
+//ErrKeyNotFound if there isn't one
+func (mng *sessionManager) Get(id, key string, v interface{}) error {
+	return mng.Update(id, func(d *SessionData) error {
+		return d.Get(key, v)
+	})
+}
+
+//Delete removes the value a session has under key
+func (mng *sessionManager) Delete(id, key string) error {
+	return mng.Update(id, func(d *SessionData) error {
+		d.Delete(key)
+		return nil
+	})
+}
+
+//GetValue is Get for when you know the type you're after:
+//
+//	cart, err := biscuit.GetValue[[]string](mng, id, "cart")
+func GetValue[T any](mng *sessionManager, id, key string) (T, error) {
+	var v T
+	err := mng.Get(id, key, &v)
+	return v, err
+}
+
+//SetValue is Set, with the compiler checking the type of the value
+func SetValue[T any](mng *sessionManager, id, key string, v T) error {
+	return mng.Set(id, key, v)
+}
@@ -1,12 +1,20 @@
 package biscuit
 
 import (
-	"crypto/md5"
-	"crypto/sha512"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/Jonny-Burkholder/biscuit/pkg/clientip"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 /*This part of the package is under construction. Note that stronger security features and more robust
@@ -14,6 +22,18 @@ errors are on the way*/
 
 //this file is for security measures like encrypting cookies and checking ip addresses
 
+//ciphers for encrypting cookies
+const (
+	CipherXChaCha20Poly1305 = iota //the default. Its nonces are big enough to pick at random forever
+	CipherAESGCM                   //faster on hardware with AES instructions, but only good for about 4 billion cookies per key
+)
+
+var defaultCipher int = CipherXChaCha20Poly1305
+
+//ErrInvalidCiphertext is returned when an encrypted value can't be decrypted, because it was
+//changed, it was encrypted for a different cookie, or its key isn't in the keyring anymore
+var ErrInvalidCiphertext = errors.New("Error: could not decrypt value")
+
 type errorUnauthorizedIP struct {
 	IP string
 }
@@ -23,69 +43,158 @@ func (err errorUnauthorizedIP) Error() string {
 	return "Unauthorized IP address: " + err.IP + " does not match user address."
 }
 
-//getIP returns the client's IP address
-func getIP(r *http.Request) string {
-	forwarded := r.Header.Get("X-FORWARDED-FOR")
-	if forwarded != "" {
-		return forwarded
+//SetIPResolver sets how the session manager works out a request's IP address. By default no
+//proxies are trusted, so it's always RemoteAddr without the port. Behind a load balancer or a
+//reverse proxy, pass a resolver that trusts it and reads the header it sets, or every user will
+//have the proxy's address
+func (mng *sessionManager) SetIPResolver(res *clientip.Resolver) {
+	mng.mux.Lock()
+	mng.ipResolver = res
+	mng.mux.Unlock()
+}
+
+//clientIP returns the client's IP address
+func (mng *sessionManager) clientIP(r *http.Request) string {
+	mng.mux.RLock()
+	res := mng.ipResolver
+	mng.mux.RUnlock()
+	return res.ClientIP(r)
+}
+
+//Hash hashes a password with the session manager's password hasher, argon2id unless it's been
+//changed. The hash is a PHC string, so it says how it was made, and CheckPassword can check it
+//even after the manager moves on to a different hasher
+func (mng *sessionManager) Hash(s string) ([]byte, error) {
+	h, err := mng.getPasswordHasher()
+	if err != nil {
+		return []byte{}, err
 	}
-	return r.RemoteAddr
+	hash, err := h.Hash(s)
+	if err != nil {
+		return []byte{}, err
+	}
+	return []byte(hash), nil
 }
 
-//ValidateIP returns an error if a session cookie comes from an IP address other than
-//what is stored in the session manager
-func (mng *sessionManager) ValidateIP(r *http.Request, sess *session) error {
-	rAddress := getIP(r)
-	ip, ok := sess.ipAddress[rAddress]
+//CheckPassword takes a password string and compares it to a hash to see if they match.
+//The function returns ErrPasswordMismatch if they do not match, and nil if they do match. The
+//hash can come from any of the built in hashers, or one given to SetPasswordHasher
+func (mng *sessionManager) CheckPassword(pswd string, hash []byte) error {
+	h, err := mng.hasherFor(string(hash))
+	if err != nil {
+		return err
+	}
+	ok, err := h.Verify(pswd, string(hash))
+	if err != nil {
+		return err
+	}
 	if ok != true {
-		mng.addIP(sess, rAddress)
+		return ErrPasswordMismatch
 	}
-	if ip != true {
-		return errorUnauthorizedIP{IP: rAddress}
+	return nil
+}
+
+//SetCipher changes which cipher the session manager encrypts cookies with, CipherXChaCha20Poly1305
+//or CipherAESGCM. Anything encrypted with the old cipher can't be decrypted after the change
+func (mng *sessionManager) SetCipher(i int) error {
+	if i != CipherXChaCha20Poly1305 && i != CipherAESGCM {
+		return fmt.Errorf("Error: cipher %v not supported", i)
 	}
+	mng.mux.Lock()
+	mng.cipher = i
+	mng.mux.Unlock()
 	return nil
 }
 
-//Hash returns a hash from an input string based on the session manager's encryption type
-func (mng *sessionManager) Hash(s string) ([]byte, error) {
-	switch mng.encryptionType {
-	case "bcrypt":
-		hash, err := bcrypt.GenerateFromPassword([]byte(s), mng.hashStrength)
+//newAEAD derives an encryption key from a signing secret and sets up the cipher with it. The
+//signing keys never get used for encryption directly, HKDF turns each one into a second,
+//unrelated key
+func newAEAD(kind int, secret []byte) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	info := fmt.Sprintf("biscuit cookie encryption %v", kind)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	if kind == CipherAESGCM {
+		block, err := aes.NewCipher(key)
 		if err != nil {
-			return []byte{}, err
-		}
-		return hash, nil
-	case "md5": //non b-crypt hashing will be updated in the future to incorporate hashing rounds as well as salting
-		//initial hash
-		hash := md5.Sum([]byte(s))
-
-		//re-hash according to manager hash strength
-		for i := 1; i < mng.hashStrength; i++ {
-			hash = md5.Sum(hash[:])
+			return nil, err
 		}
+		return cipher.NewGCM(block)
+	}
+	return chacha20poly1305.NewX(key)
+}
 
-		return hash[:], nil
-	case "sha512":
-		//initial hash
-		hash := sha512.Sum512([]byte(s))
+//Encrypt seals data for the cookie with the given name, using the keyring's active key. The
+//cookie name goes in as associated data, so a value encrypted for one cookie won't decrypt as
+//another. The result looks like keyID.ciphertext, with the nonce at the front of the ciphertext
+func (mng *sessionManager) Encrypt(name string, data []byte) (string, error) {
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	return mng.encrypt(name, data)
+}
 
-		//re-hash for strength and stuff
-		for i := 1; i < mng.hashStrength; i++ {
-			hash = sha512.Sum512(hash[:])
-		}
+//encrypt does the work for Encrypt, for callers that are already inside enter
+func (mng *sessionManager) encrypt(name string, data []byte) (string, error) {
+	mng.mux.RLock()
+	k, kind := mng.keyring, mng.cipher
+	mng.mux.RUnlock()
+	k.mux.RLock()
+	id, secret := k.active, k.keys[k.active]
+	k.mux.RUnlock()
+	aead, err := newAEAD(kind, secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, data, []byte(name))
+	return id + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
 
-		return hash[:], nil
-	default:
-		return []byte{}, fmt.Errorf("Error hashing data: %q not supported.", s)
+//Decrypt opens a value made by Encrypt for the cookie with the given name. Any key still in the
+//keyring can decrypt, so rotating keys works the same way it does for signing
+func (mng *sessionManager) Decrypt(name, value string) ([]byte, error) {
+	if err := mng.enter(); err != nil {
+		return nil, err
 	}
+	defer mng.leave()
+	return mng.decrypt(name, value)
 }
 
-//CheckPassword takes a password string and compares it to a hash to see if they match.
-//The function returns an error if they do not match, and nil if they do match
-func (mng *sessionManager) CheckPassword(pswd string, hash []byte) error {
-	if mng.encryptionType == "bcrypt" {
-		return bcrypt.CompareHashAndPassword(hash, []byte(pswd))
-	} else {
-		return fmt.Errorf("Sorry, still working on anything that's not bcrypt")
+//decrypt does the work for Decrypt, for callers that are already inside enter
+func (mng *sessionManager) decrypt(name, value string) ([]byte, error) {
+	mng.mux.RLock()
+	k, kind := mng.keyring, mng.cipher
+	mng.mux.RUnlock()
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return nil, ErrInvalidCiphertext
+	}
+	k.mux.RLock()
+	secret, ok := k.keys[value[:i]]
+	k.mux.RUnlock()
+	if ok != true {
+		return nil, ErrInvalidCiphertext
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	aead, err := newAEAD(kind, secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, ErrInvalidCiphertext
 	}
+	return data, nil
 }
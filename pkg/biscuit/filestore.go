@@ -0,0 +1,333 @@
+package biscuit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//this file is for the file-backed session store. Every change to a session is appended to a
+//journal and synced to disk before the call returns, and every so often the whole store is
+//written out as a snapshot so the journal doesn't grow forever. On startup the snapshot is
+//loaded and the journal is replayed on top of it
+
+const snapshotFileName = "sessions.snapshot"
+
+const journalFileName = "sessions.journal"
+
+var defaultSnapshotEvery int = 1000 //number of journal entries written before the store takes a new snapshot
+
+//journalEntry is one line of the journal. Op tells us which of the other fields are in use
+type journalEntry struct {
+	Op       string         `json:"op"` //"put", "delete", "touch" or "deleteuser"
+	Record   *SessionRecord `json:"rec,omitempty"`
+	ID       string         `json:"id,omitempty"`
+	Username string         `json:"user,omitempty"`
+	Time     time.Time      `json:"t,omitempty"`
+}
+
+//fileStore keeps a copy of every session in memory for reads, and writes every change to disk.
+//All of the journal ops are idempotent, so replaying an entry that's already in the snapshot is
+//harmless. That's what lets us get away without sequence numbers
+type fileStore struct {
+	mux           sync.Mutex
+	mem           *memoryStore
+	dir           string
+	journal       *os.File
+	entries       int
+	snapshotEvery int
+}
+
+//NewFileStore opens (or creates) a file-backed session store in the directory at path. Any
+//sessions already on disk are loaded before it returns. A half-written journal entry left behind
+//by a crash is thrown away, since the call that wrote it never returned successfully
+func NewFileStore(path string) (*fileStore, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	s := &fileStore{
+		mem:           NewMemoryStore(),
+		dir:           path,
+		snapshotEvery: defaultSnapshotEvery,
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//SetSnapshotEvery sets how many journal entries are written before the store compacts itself
+//into a new snapshot. Anything less than 1 is ignored
+func (s *fileStore) SetSnapshotEvery(i int) {
+	if i < 1 {
+		return
+	}
+	s.mux.Lock()
+	s.snapshotEvery = i
+	s.mux.Unlock()
+}
+
+//loadSnapshot reads the last snapshot, if there is one, into memory
+func (s *fileStore) loadSnapshot() error {
+	f, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var recs []*SessionRecord
+	if err := json.Unmarshal(f, &recs); err != nil {
+		return fmt.Errorf("Error: session snapshot is corrupt: %v", err)
+	}
+	for _, rec := range recs {
+		s.mem.Put(rec)
+	}
+	return nil
+}
+
+//replay applies every good entry in the journal, then truncates anything after the last good
+//entry so new entries don't get appended after garbage
+func (s *fileStore) replay() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, journalFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	var good int64
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break //a line without a newline is a torn write, so we stop here either way
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		entry, ok := decodeJournalLine(line)
+		if ok != true {
+			break
+		}
+		s.apply(entry)
+		s.entries++
+		good += int64(len(line))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.journal = f
+	return nil
+}
+
+//encodeJournalLine turns an entry into a line of the form "<crc32> <json>\n". The checksum lets
+//replay tell a complete entry from one that was cut off partway through
+func encodeJournalLine(entry *journalEntry) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	line := strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 16) + " "
+	return append(append([]byte(line), data...), '\n'), nil
+}
+
+//decodeJournalLine is the reverse of encodeJournalLine. It returns false if the line is damaged
+func decodeJournalLine(line []byte) (*journalEntry, bool) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return nil, false
+	}
+	sum, err := strconv.ParseUint(string(line[:i]), 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(line[i+1:]) {
+		return nil, false
+	}
+	entry := &journalEntry{}
+	if err := json.Unmarshal(line[i+1:], entry); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+//apply makes the change described by a journal entry to the in-memory copy of the store
+func (s *fileStore) apply(entry *journalEntry) {
+	switch entry.Op {
+	case "put":
+		if entry.Record != nil {
+			s.mem.Put(entry.Record)
+		}
+	case "delete":
+		s.mem.Delete(entry.ID)
+	case "touch":
+		s.mem.Touch(entry.ID, entry.Time)
+	case "deleteuser":
+		s.mem.DeleteByUser(entry.Username)
+	}
+}
+
+//write syncs an entry to the journal and then applies it in memory. If the journal
+//write fails, nothing in memory changes. Once the entry is synced the change has happened, so a
+//snapshot that fails afterwards is only logged, and tried again on the next write
+func (s *fileStore) write(entry *journalEntry) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.journal == nil {
+		return fmt.Errorf("Error: file store %q is closed", s.dir)
+	}
+	line, err := encodeJournalLine(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.journal.Write(line); err != nil {
+		return err
+	}
+	if err := s.journal.Sync(); err != nil {
+		return err
+	}
+	s.apply(entry)
+	s.entries++
+	if s.entries >= s.snapshotEvery {
+		if err := s.snapshot(); err != nil {
+			log.Printf("biscuit: couldn't take a snapshot of file store %q: %v", s.dir, err)
+		}
+	}
+	return nil
+}
+
+//snapshot writes the whole store to a temp file, syncs it, and renames it over the old snapshot,
+//so the snapshot on disk is always either the old one or the new one and never half of each. Only
+//then is the journal emptied. Must be called with s.mux held
+func (s *fileStore) snapshot() error {
+	recs, err := s.mem.List()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, snapshotFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, snapshotFileName)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	//if we crash right here, the old journal gets replayed on top of the new snapshot, which
+	//is fine since every entry is idempotent
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.entries = 0
+	return s.journal.Sync()
+}
+
+//syncDir makes sure a rename inside dir has actually made it to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//Snapshot forces the store to compact its journal into a new snapshot right now
+func (s *fileStore) Snapshot() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.journal == nil {
+		return fmt.Errorf("Error: file store %q is closed", s.dir)
+	}
+	return s.snapshot()
+}
+
+//Close takes a final snapshot and closes the journal. The store can't be used after it's closed
+func (s *fileStore) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.snapshot()
+	if cerr := s.journal.Close(); err == nil {
+		err = cerr
+	}
+	s.journal = nil
+	return err
+}
+
+//Get returns a copy of the session with the given ID
+func (s *fileStore) Get(id string) (*SessionRecord, error) {
+	return s.mem.Get(id)
+}
+
+//Put writes the session to the journal
+func (s *fileStore) Put(rec *SessionRecord) error {
+	return s.write(&journalEntry{Op: "put", Record: rec})
+}
+
+//Delete writes the removal of a session to the journal
+func (s *fileStore) Delete(id string) error {
+	return s.write(&journalEntry{Op: "delete", ID: id})
+}
+
+//Touch writes the new LastSeen time of a session to the journal
+func (s *fileStore) Touch(id string, t time.Time) error {
+	if _, err := s.mem.Get(id); err != nil {
+		return err
+	}
+	return s.write(&journalEntry{Op: "touch", ID: id, Time: t})
+}
+
+//List returns copies of every session in the store
+func (s *fileStore) List() ([]*SessionRecord, error) {
+	return s.mem.List()
+}
+
+//ListByUser returns copies of every session belonging to a user
+func (s *fileStore) ListByUser(username string) ([]*SessionRecord, error) {
+	return s.mem.ListByUser(username)
+}
+
+//DeleteByUser writes the removal of every session belonging to a user to the journal
+func (s *fileStore) DeleteByUser(username string) error {
+	return s.write(&journalEntry{Op: "deleteuser", Username: username})
+}
@@ -0,0 +1,199 @@
+package biscuit
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//this file is for binding sessions to the device they were started on. IP addresses change every
+//time a phone goes from wifi to mobile data, but the browser doesn't, so a session remembers a
+//rough fingerprint of the browser instead: which browser and OS it is, its language, and the
+//client hints it sends. None of it is secret, so this only stops the lazy kind of cookie theft,
+//but it costs the real user nothing
+
+//fingerprint policies, for what happens when a session shows up on a different device
+const (
+	FingerprintOff    = iota //fingerprints are recorded but never checked
+	FingerprintLog           //the mismatch is logged, and the request goes through
+	FingerprintReauth        //the session is logged out, and whichever device logs in again gets it
+	FingerprintReject        //the request is refused, but the session is left alone for the real device
+)
+
+//ErrFingerprintMismatch is returned under FingerprintReject when a session is used from a
+//device that doesn't match the one it was started on
+var ErrFingerprintMismatch = errors.New("Error: session used from a different device")
+
+//ErrReauthRequired is returned under FingerprintReauth when a session was used from a different
+//device. The session has been logged out, and Login will bring it back
+var ErrReauthRequired = errors.New("Error: session has to log in again")
+
+//Fingerprint is what a session remembers about the browser it was started in
+type Fingerprint struct {
+	Browser  string //the browser family, like "Chrome" or "Firefox"
+	Version  int    //the browser's major version
+	OS       string
+	Mobile   bool
+	Language string //the user's first choice in Accept-Language
+	Platform string //from the Sec-CH-UA-Platform client hint, if the browser sends it
+}
+
+//browsers are checked in order, since most user agents claim to be several browsers at once.
+//Edge says it's Chrome, and Chrome says it's Safari
+var browserTokens = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"}, //Safari keeps its real version here, not after "Safari/"
+}
+
+var osTokens = []struct{ token, name string }{
+	{"Windows", "Windows"},
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+//parseUserAgent picks the browser family, major version and OS out of a User-Agent header.
+//Anything it doesn't recognize is named after the first product in the header, like "curl"
+func parseUserAgent(ua string) (browser string, version int, os string) {
+	for _, b := range browserTokens {
+		if i := strings.Index(ua, b.token); i >= 0 {
+			browser = b.name
+			version = majorVersion(ua[i+len(b.token):])
+			break
+		}
+	}
+	if browser == "" && ua != "" {
+		product := strings.Fields(ua)[0]
+		if i := strings.IndexByte(product, '/'); i >= 0 {
+			browser, version = product[:i], majorVersion(product[i+1:])
+		} else {
+			browser = product
+		}
+	}
+	for _, o := range osTokens {
+		if strings.Contains(ua, o.token) {
+			os = o.name
+			break
+		}
+	}
+	return browser, version, os
+}
+
+//majorVersion reads the number at the start of a version string like "126.0.6478.61"
+func majorVersion(s string) int {
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(s)
+	}
+	v, _ := strconv.Atoi(s[:end])
+	return v
+}
+
+//NewFingerprint reads a request's fingerprint
+func NewFingerprint(r *http.Request) *Fingerprint {
+	fp := &Fingerprint{}
+	fp.Browser, fp.Version, fp.OS = parseUserAgent(r.UserAgent())
+	fp.Mobile = strings.Contains(r.UserAgent(), "Mobile") || r.Header.Get("Sec-CH-UA-Mobile") == "?1"
+	if lang := r.Header.Get("Accept-Language"); lang != "" {
+		lang = strings.Split(lang, ",")[0]
+		lang = strings.Split(lang, ";")[0]
+		fp.Language = strings.ToLower(strings.TrimSpace(lang))
+	}
+	fp.Platform = strings.Trim(r.Header.Get("Sec-CH-UA-Platform"), `"`)
+	return fp
+}
+
+//Matches reports whether other could be the same browser as fp. A newer version of the same
+//browser matches, since browsers update themselves all the time, but an older one doesn't.
+//Headers that only one side has, like client hints that only go out over HTTPS, are ignored
+func (fp *Fingerprint) Matches(other *Fingerprint) bool {
+	if fp.Browser != other.Browser || fp.OS != other.OS || fp.Mobile != other.Mobile {
+		return false
+	}
+	if other.Version < fp.Version {
+		return false
+	}
+	if fp.Language != "" && other.Language != "" && fp.Language != other.Language {
+		return false
+	}
+	if fp.Platform != "" && other.Platform != "" && fp.Platform != other.Platform {
+		return false
+	}
+	return true
+}
+
+//String describes a fingerprint for logs
+func (fp *Fingerprint) String() string {
+	return fmt.Sprintf("%v %v on %v (mobile: %v, language: %q, platform: %q)", fp.Browser, fp.Version, fp.OS, fp.Mobile, fp.Language, fp.Platform)
+}
+
+//SetFingerprintPolicy sets what VerifySessionWithIP does when a session is used from a device
+//that doesn't match the one it was started on. It should be FingerprintOff, FingerprintLog,
+//FingerprintReauth or FingerprintReject
+func (mng *sessionManager) SetFingerprintPolicy(i int) error {
+	if i < FingerprintOff || i > FingerprintReject {
+		return fmt.Errorf("Error: unknown fingerprint policy %v", i)
+	}
+	mng.mux.Lock()
+	mng.fingerprintPolicy = i
+	mng.mux.Unlock()
+	return nil
+}
+
+//checkFingerprint compares a request against the device its session was started on, and
+//applies the manager's policy if they don't match. A tolerated browser upgrade is saved, so
+//the session doesn't match an older version again afterwards
+func (mng *sessionManager) checkFingerprint(sess *session, r *http.Request) error {
+	mng.mux.RLock()
+	policy := mng.fingerprintPolicy
+	mng.mux.RUnlock()
+	if policy == FingerprintOff || sess.fingerprint == nil {
+		return nil //sessions from before fingerprints were recorded get a pass
+	}
+	fp := NewFingerprint(r)
+	if sess.fingerprint.Matches(fp) {
+		if fp.Version <= sess.fingerprint.Version {
+			return nil
+		}
+		defer mng.lockSession(sess.cookieID)()
+		latest, err := mng.getSession(sess.cookieID)
+		if err != nil || latest.fingerprint == nil {
+			return err
+		}
+		latest.fingerprint.Version = fp.Version
+		return mng.save(latest)
+	}
+	switch policy {
+	case FingerprintLog:
+		log.Printf("biscuit: session %v started on %v, but was used from %v", sess.cookieID, sess.fingerprint, fp)
+		return nil
+	case FingerprintReauth:
+		defer mng.lockSession(sess.cookieID)()
+		latest, err := mng.getSession(sess.cookieID)
+		if err != nil {
+			return err
+		}
+		latest.alive = false
+		latest.fingerprint = fp //if this device can log in again, it's the one the session belongs to
+		if err := mng.save(latest); err != nil {
+			return err
+		}
+		if mng.isStateless() {
+			mng.revoke(latest) //the browser's cookie still says it's logged in
+		}
+		return ErrReauthRequired
+	}
+	return ErrFingerprintMismatch
+}
@@ -0,0 +1,161 @@
+package biscuit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//this file is for flash messages, the one-time notes like "wrong password" or "you've been logged
+//out" that one page leaves for the next one, usually across a redirect. If the request has a
+//session, flashes are kept in it on the server. Otherwise they go in a signed cookie. Either way,
+//reading them clears them, so they only show up once
+
+//flash levels
+const (
+	FlashInfo  = "info"
+	FlashWarn  = "warn"
+	FlashError = "error"
+)
+
+//Flash is one flash message
+type Flash struct {
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+}
+
+//String returns the message, so a flash can be printed straight into a template
+func (f Flash) String() string {
+	return f.Message
+}
+
+//FlashList is the flashes waiting for a request. Its methods are there so templates can pick
+//out the ones they want, like {{range .Flashes.ByLevel "error"}}{{.Message}}{{end}}
+type FlashList []Flash
+
+//ByLevel returns the flashes with the given level
+func (l FlashList) ByLevel(level string) FlashList {
+	var out FlashList
+	for _, f := range l {
+		if f.Level == level {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+//Has reports whether there are any flashes with the given level
+func (l FlashList) Has(level string) bool {
+	return len(l.ByLevel(level)) > 0
+}
+
+//flashSession returns the ID of the session behind a request, if it has one the flashes can go
+//in. Stateless sessions don't count, since their record lives in a cookie that would have to be
+//sent out again every time a flash changed
+func (mng *sessionManager) flashSession(r *http.Request) (string, bool) {
+	if mng.isStateless() {
+		return "", false
+	}
+	c, err := r.Cookie(mng.SessionCookie())
+	if err != nil {
+		return "", false
+	}
+	id, err := mng.readSessionCookie(c)
+	if err != nil {
+		return "", false
+	}
+	sess, err := mng.getSession(id)
+	if err != nil {
+		return "", false
+	}
+	return sess.cookieID, true //the cookie might still have an ID from before a rotation
+}
+
+//AddFlash leaves a message for the next page the user sees. The level should be FlashInfo,
+//FlashWarn or FlashError
+func (mng *sessionManager) AddFlash(w http.ResponseWriter, r *http.Request, level, message string) error {
+	if level != FlashInfo && level != FlashWarn && level != FlashError {
+		return fmt.Errorf("Error: unknown flash level %q", level)
+	}
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	f := Flash{Level: level, Message: message}
+	if id, ok := mng.flashSession(r); ok {
+		unlock := mng.lockSession(id)
+		defer unlock()
+		sess, err := mng.getSession(id)
+		if err != nil {
+			return err
+		}
+		sess.flashes = append(sess.flashes, f)
+		return mng.save(sess)
+	}
+	flashes := append(mng.readFlashCookie(r), f)
+	data, err := json.Marshal(flashes)
+	if err != nil {
+		return err
+	}
+	c := mng.newCookie(mng.names().Flash, "", 0)
+	c.Value = mng.getKeyring().sign(c.Name, base64.RawURLEncoding.EncodeToString(data), time.Now())
+	if len(c.Name)+len(c.Value)+1 > maxCookieSize {
+		return ErrCookieTooLarge
+	}
+	return mng.writeCookie(w, c)
+}
+
+//readFlashCookie decodes the flash cookie. Anything that isn't a flash cookie we signed is
+//ignored, since a flash isn't worth failing a request over
+func (mng *sessionManager) readFlashCookie(r *http.Request) FlashList {
+	c, err := r.Cookie(mng.FlashCookie())
+	if err != nil {
+		return nil
+	}
+	value, _, err := mng.getKeyring().verify(c.Name, c.Value)
+	if err != nil {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	var flashes FlashList
+	if json.Unmarshal(data, &flashes) != nil {
+		return nil
+	}
+	return flashes
+}
+
+//Flashes returns every flash waiting for a request, from the session and from the flash cookie,
+//and clears them so they aren't shown again. Call it once per request, since the cookie is only
+//deleted when the response gets to the browser
+func (mng *sessionManager) Flashes(w http.ResponseWriter, r *http.Request) (FlashList, error) {
+	if err := mng.enter(); err != nil {
+		return nil, err
+	}
+	defer mng.leave()
+	var flashes FlashList
+	if id, ok := mng.flashSession(r); ok {
+		unlock := mng.lockSession(id)
+		sess, err := mng.getSession(id)
+		if err == nil && len(sess.flashes) > 0 { //if the session ended since we found it, it took its flashes with it
+			flashes = append(flashes, sess.flashes...)
+			sess.flashes = nil
+			if err := mng.save(sess); err != nil {
+				unlock()
+				return nil, err
+			}
+		}
+		unlock()
+	}
+	if c, err := r.Cookie(mng.FlashCookie()); err == nil {
+		flashes = append(flashes, mng.readFlashCookie(r)...)
+		if err := mng.DeleteCookie(w, c); err != nil {
+			return nil, err
+		}
+	}
+	return flashes, nil
+}
@@ -0,0 +1,85 @@
+package biscuit
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+//this file is for generating session IDs. A session ID is the only thing standing between an
+//attacker and someone else's session, so it has to come from crypto/rand and be long enough
+//that nobody can guess one
+
+var defaultIDLength int = 32 //256 bits
+
+var minIDLength int = 16 //128 bits, the least OWASP says a session ID should have
+
+//encodings for randomly generated IDs
+const (
+	EncodingBase64URL = iota //the default, since it's the shortest and safe to put in a cookie or URL
+	EncodingHex
+)
+
+//IDGenerator makes new session IDs. The session manager makes sure every ID it hands out is
+//unique, but a generator should be drawing from enough randomness that it never has to
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+//randomIDGenerator makes IDs out of length bytes from crypto/rand
+type randomIDGenerator struct {
+	length   int
+	encoding int
+}
+
+//NewRandomIDGenerator returns a generator that makes IDs from length random bytes, encoded
+//as either EncodingBase64URL or EncodingHex. length has to be at least 16
+func NewRandomIDGenerator(length, encoding int) (*randomIDGenerator, error) {
+	if length < minIDLength {
+		return nil, fmt.Errorf("Error: session IDs need at least %v bytes, got %v", minIDLength, length)
+	}
+	if encoding != EncodingBase64URL && encoding != EncodingHex {
+		return nil, fmt.Errorf("Error: unknown ID encoding %v", encoding)
+	}
+	return &randomIDGenerator{length: length, encoding: encoding}, nil
+}
+
+//NewID reads a new ID from crypto/rand
+func (g *randomIDGenerator) NewID() (string, error) {
+	b := make([]byte, g.length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	if g.encoding == EncodingHex {
+		return hex.EncodeToString(b), nil
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//uuidV7Generator makes version 7 UUIDs, which start with a millisecond timestamp so they
+//sort by creation time, which is nice when you're reading logs or database indexes. The
+//other 74 bits are random, which is less than the default generator, but still plenty
+type uuidV7Generator struct{}
+
+//NewUUIDv7Generator returns a generator that makes time-sortable UUIDs, as laid out in RFC 9562
+func NewUUIDv7Generator() *uuidV7Generator {
+	return &uuidV7Generator{}
+}
+
+//NewID makes a new UUIDv7, like "01890a5d-ac96-774b-bcce-b302099a8057"
+func (g *uuidV7Generator) NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(b[:6], ms[2:])
+	b[6] = b[6]&0x0f | 0x70 //version 7
+	b[8] = b[8]&0x3f | 0x80 //RFC 4122 variant
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
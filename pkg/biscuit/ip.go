@@ -0,0 +1,212 @@
+package biscuit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Jonny-Burkholder/biscuit/pkg/clientip"
+)
+
+//this file is for deciding which IP addresses a session can be used from. Each session keeps a
+//list of addresses and networks, each one allowed or blocked, and an address is judged by the
+//most specific entry that contains it, so a session can allow 198.51.100.0/24 but still block one
+//address inside it. Anything that isn't on the list at all is turned away. On top of that, the
+//manager keeps a blocklist of networks that no session can be used from, or started from
+
+//ErrUnknownIP is returned by NewSession when there's no telling what address the request came
+//from. A session started without one could never pass VerifySessionWithIP, so it isn't started
+var ErrUnknownIP = errors.New("Error: could not work out the request's IP address")
+
+var defaultIPv4Bits, defaultIPv6Bits int = 32, 128 //by default a session is bound to the exact address it started on
+
+//parseNetwork reads an IP address or a CIDR, and returns the network along with the way it's
+//written in a session's IP list: a plain address for a single address, and a CIDR otherwise
+func parseNetwork(s string) (*net.IPNet, string, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error: %q is not an IP address or CIDR", s)
+		}
+		if ones, bits := network.Mask.Size(); ones == bits {
+			return network, network.IP.String(), nil
+		}
+		return network, network.String(), nil
+	}
+	ip := clientip.Parse(s) //this also reads the addresses with ports older versions of biscuit saved
+	if ip == nil {
+		return nil, "", fmt.Errorf("Error: %q is not an IP address or CIDR", s)
+	}
+	bits := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, ip.String(), nil
+}
+
+//SetIPBinding sets how much of a session's starting address it's bound to. The defaults of 32
+//and 128 bind it to the exact address, while something like 24 and 64 lets it move around the
+//same network, which is kinder to phones that get a new address every so often. It only changes
+//sessions started after it's called
+func (mng *sessionManager) SetIPBinding(v4Bits, v6Bits int) error {
+	if v4Bits < 1 || v4Bits > 32 || v6Bits < 1 || v6Bits > 128 {
+		return fmt.Errorf("Error: IP binding has to be between 1 and 32 bits for IPv4, and 1 and 128 for IPv6, got %v and %v", v4Bits, v6Bits)
+	}
+	mng.mux.Lock()
+	mng.ipv4Bits, mng.ipv6Bits = v4Bits, v6Bits
+	mng.mux.Unlock()
+	return nil
+}
+
+//bindIP returns the entry a new session gets for the address it was started from
+func (mng *sessionManager) bindIP(ip net.IP) string {
+	mng.mux.RLock()
+	ones := mng.ipv6Bits
+	if len(ip) == net.IPv4len {
+		ones = mng.ipv4Bits
+	}
+	mng.mux.RUnlock()
+	bits := 8 * len(ip)
+	if ones >= bits {
+		return ip.String()
+	}
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	return network.String()
+}
+
+//checkIPList finds the most specific entry in a session's IP list that contains ip, and reports
+//whether it's allowed. If an allowed and a blocked entry are just as specific, blocked wins, and
+//if there's no entry at all, ip isn't allowed
+func checkIPList(list map[string]bool, ip net.IP) bool {
+	allowed := false
+	best := -1
+	for entry, ok := range list {
+		network, _, err := parseNetwork(entry)
+		if err != nil || network.Contains(ip) != true {
+			continue
+		}
+		ones, _ := network.Mask.Size()
+		if ones > best || (ones == best && ok != true) {
+			best, allowed = ones, ok
+		}
+	}
+	return allowed
+}
+
+//BlockNetwork adds an address or a CIDR to the manager's blocklist. No session can be started
+//from it, and no session can be used from it, whatever the session's own list says
+func (mng *sessionManager) BlockNetwork(cidr string) error {
+	network, key, err := parseNetwork(cidr)
+	if err != nil {
+		return err
+	}
+	mng.mux.Lock()
+	mng.blocklist[key] = network
+	mng.mux.Unlock()
+	return nil
+}
+
+//UnblockNetwork takes an address or a CIDR back off the blocklist. It has to be written the same
+//way it was blocked, give or take how the address is formatted
+func (mng *sessionManager) UnblockNetwork(cidr string) error {
+	_, key, err := parseNetwork(cidr)
+	if err != nil {
+		return err
+	}
+	mng.mux.Lock()
+	delete(mng.blocklist, key)
+	mng.mux.Unlock()
+	return nil
+}
+
+//Blocklist returns everything on the manager's blocklist, in order
+func (mng *sessionManager) Blocklist() []string {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	list := make([]string, 0, len(mng.blocklist))
+	for key := range mng.blocklist {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return list
+}
+
+//blocked reports whether ip is on the manager's blocklist
+func (mng *sessionManager) blocked(ip net.IP) bool {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	for _, network := range mng.blocklist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//AllowIP lets a session be used from an address or a CIDR, like "198.51.100.0/24"
+func (mng *sessionManager) AllowIP(id, ip string) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	return mng.setIP(id, ip, true)
+}
+
+//BlockIP stops a session from being used from an address or a CIDR. A blocked entry beats an
+//allowed one that's less specific, so a single address can be blocked inside an allowed network
+func (mng *sessionManager) BlockIP(id, ip string) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	return mng.setIP(id, ip, false)
+}
+
+//setIP sets the state of an address or network on the latest copy of a session in the store
+func (mng *sessionManager) setIP(id, ip string, allowed bool) error {
+	_, key, err := parseNetwork(ip)
+	if err != nil {
+		return err
+	}
+	unlock := mng.lockSession(id)
+	sess, err := mng.getSession(id)
+	if err == nil && sess.cookieID != id {
+		//the session was rotated, so it has to be locked under the ID it has now
+		unlock()
+		unlock = mng.lockSession(sess.cookieID)
+		sess, err = mng.getSession(sess.cookieID)
+	}
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	sess.ipAddress[key] = allowed
+	return mng.save(sess)
+}
+
+//ValidateIP returns an error if a request for a session comes from an IP address the session
+//isn't allowed to be used from, or one that's on the manager's blocklist
+func (mng *sessionManager) ValidateIP(r *http.Request, id string) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	sess, err := mng.getSession(id)
+	if err != nil {
+		return err
+	}
+	return mng.validateIP(sess, r)
+}
+
+//validateIP does the work for ValidateIP
+func (mng *sessionManager) validateIP(sess *session, r *http.Request) error {
+	address := mng.clientIP(r)
+	ip := clientip.Parse(address)
+	if ip == nil || mng.blocked(ip) {
+		return errorUnauthorizedIP{IP: address}
+	}
+	if checkIPList(sess.ipAddress, ip) != true {
+		return errorUnauthorizedIP{IP: address}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package biscuit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//this file is for limiting how many sessions one user can have open at once, like when a
+//streaming site only lets you watch on so many screens. When a user who's already at the limit
+//starts another session, the policy decides what happens
+
+//session limit policies
+const (
+	LimitReject      = iota //the new session is refused with ErrTooManySessions
+	LimitEvictOldest        //the session that was created first is ended to make room
+	LimitEvictLRU           //the session that was used least recently is ended to make room
+)
+
+//ErrTooManySessions is returned by NewSession when a user is at their limit and the policy is
+//LimitReject
+var ErrTooManySessions = errors.New("Error: user has too many sessions")
+
+//SetMaxSessionsPerUser sets how many sessions one user can have at the same time. 0, the
+//default, means there's no limit. Sessions without a username are never limited
+func (mng *sessionManager) SetMaxSessionsPerUser(i int) {
+	mng.mux.Lock()
+	mng.maxSessionsPerUser = i
+	mng.mux.Unlock()
+}
+
+//SetSessionLimitPolicy sets what happens when a user at their limit starts another session. It
+//should be LimitReject, LimitEvictOldest or LimitEvictLRU
+func (mng *sessionManager) SetSessionLimitPolicy(i int) error {
+	if i < LimitReject || i > LimitEvictLRU {
+		return fmt.Errorf("Error: unknown session limit policy %v", i)
+	}
+	mng.mux.Lock()
+	mng.sessionLimitPolicy = i
+	mng.mux.Unlock()
+	return nil
+}
+
+//userSessions returns a user's live sessions, oldest first. The records left behind by rotation
+//point at sessions that are already in the list, so they aren't counted twice
+func (mng *sessionManager) userSessions(username string) ([]*SessionRecord, error) {
+	store := mng.getStore()
+	var recs []*SessionRecord
+	var err error
+	if lister, ok := store.(UserLister); ok {
+		recs, err = lister.ListByUser(username)
+	} else {
+		recs, err = store.List()
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var live []*SessionRecord
+	for _, rec := range recs {
+		if rec.Username != username || rec.RotatedTo != "" || mng.dead(rec, now) || mng.isRevoked(rec.ID) {
+			continue
+		}
+		live = append(live, rec)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].Created.Before(live[j].Created)
+	})
+	return live, nil
+}
+
+//ListUserSessions returns every live session a user has, oldest first, for things like a page
+//that shows the user where they're logged in
+func (mng *sessionManager) ListUserSessions(username string) ([]*SessionRecord, error) {
+	if err := mng.enter(); err != nil {
+		return nil, err
+	}
+	defer mng.leave()
+	return mng.userSessions(username)
+}
+
+//RevokeAllForUser ends every session a user has except the one with ID exceptID, which is what a
+//"log out everywhere else" button wants. Pass an empty exceptID to end all of them
+func (mng *sessionManager) RevokeAllForUser(username, exceptID string) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	if exceptID != "" {
+		//the ID might be from before a rotation, so find out what the session is called now
+		if sess, err := mng.getSession(exceptID); err == nil {
+			exceptID = sess.cookieID
+		}
+	}
+	recs, err := mng.userSessions(username)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if rec.ID == exceptID {
+			continue
+		}
+		if err := mng.endSession(rec.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//endSession removes a session from the store for good. In stateless mode the browser still has a
+//cookie with the whole session in it, so the ID is revoked too
+func (mng *sessionManager) endSession(id string) error {
+	defer mng.lockSession(id)()
+	sess, err := mng.getSession(id)
+	if err != nil {
+		return nil //it's already gone
+	}
+	if mng.isStateless() {
+		mng.revoke(sess)
+	}
+	return mng.getStore().Delete(id)
+}
+
+//makeRoom is called by NewSession before it adds a session for username. It applies the
+//manager's limit and policy, ending sessions if it has to. The caller holds limitMux, so two new
+//sessions for the same user can't both squeeze into the last spot
+func (mng *sessionManager) makeRoom(username string, max, policy int) error {
+	recs, err := mng.userSessions(username)
+	if err != nil {
+		return err
+	}
+	extra := len(recs) - max + 1
+	if extra <= 0 {
+		return nil
+	}
+	if policy == LimitReject {
+		return ErrTooManySessions
+	}
+	if policy == LimitEvictLRU {
+		sort.SliceStable(recs, func(i, j int) bool {
+			return recs[i].LastSeen.Before(recs[j].LastSeen)
+		})
+	}
+	for _, rec := range recs[:extra] {
+		if err := mng.endSession(rec.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
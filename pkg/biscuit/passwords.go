@@ -0,0 +1,395 @@
+package biscuit
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+//this file is for hashing passwords. Every hasher writes its hashes as PHC strings, like
+//"$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>", which say which algorithm made them and with
+//what settings, so a hash can always be checked no matter which hasher the manager is using now.
+//That means the default can be made stronger at any time without locking anyone out. bcrypt has
+//its own "$2a$10$..." format from before PHC strings were a thing, and it says all the same things
+
+//ErrPasswordMismatch is returned by CheckPassword when a password doesn't match its hash
+var ErrPasswordMismatch = errors.New("Error: password does not match")
+
+//PasswordHasher hashes passwords into self-describing strings, and checks passwords against them
+type PasswordHasher interface {
+	ID() string                                    //the name at the start of the hashes it makes, like "argon2id"
+	Hash(password string) (string, error)          //hashes a password with a new random salt
+	Verify(password, encoded string) (bool, error) //the error is for hashes it can't read, not wrong passwords
+}
+
+//password hashers the manager knows about without being told
+const (
+	HasherArgon2id = "argon2id" //the default
+	HasherScrypt   = "scrypt"
+	HasherBcrypt   = "bcrypt"
+	HasherPBKDF2   = "pbkdf2-sha256"
+)
+
+const (
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+)
+
+//the most work a stored hash can ask for. The parameters come out of the hash, which might come
+//from somewhere that isn't trusted, so without these one bad string could make a single Verify
+//allocate terabytes or run for days. They're way past anything you'd sensibly hash with
+const (
+	maxPasswordMemory = 4 << 30 //bytes, for argon2id and scrypt
+	maxPasswordPasses = 1 << 10 //argon2id's t, and scrypt's p
+	maxPBKDF2Rounds   = 1 << 24
+)
+
+//b64 is the base64 PHC strings use, the standard alphabet without padding
+var b64 = base64.RawStdEncoding
+
+//newSalt returns a random salt for a password hash
+func newSalt() ([]byte, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+//phcHash is a PHC string taken apart. All the hashers here only have numbers for parameters
+type phcHash struct {
+	id      string
+	version int //0 if the string doesn't have one
+	params  map[string]int
+	salt    []byte
+	hash    []byte
+}
+
+//parsePHC takes apart a string like "$id$v=19$a=1,b=2$salt$hash", where the version is optional
+func parsePHC(encoded string) (*phcHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 5 || parts[0] != "" {
+		return nil, fmt.Errorf("Error: %q is not a PHC string", encoded)
+	}
+	p := &phcHash{id: parts[1], params: make(map[string]int)}
+	fields := parts[2:]
+	if strings.HasPrefix(fields[0], "v=") {
+		v, err := strconv.Atoi(strings.TrimPrefix(fields[0], "v="))
+		if err != nil {
+			return nil, fmt.Errorf("Error: bad version in %q", encoded)
+		}
+		p.version = v
+		fields = fields[1:]
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Error: %q is not a PHC string", encoded)
+	}
+	for _, param := range strings.Split(fields[0], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Error: bad parameter %q in %q", param, encoded)
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("Error: bad parameter %q in %q", param, encoded)
+		}
+		p.params[kv[0]] = v
+	}
+	var err error
+	if p.salt, err = b64.DecodeString(fields[1]); err != nil {
+		return nil, fmt.Errorf("Error: bad salt in %q", encoded)
+	}
+	if p.hash, err = b64.DecodeString(fields[2]); err != nil || len(p.hash) == 0 {
+		return nil, fmt.Errorf("Error: bad hash in %q", encoded)
+	}
+	return p, nil
+}
+
+//param returns one of a hash's parameters, or an error if it doesn't have it
+func (p *phcHash) param(name string) (int, error) {
+	v, ok := p.params[name]
+	if ok != true {
+		return 0, fmt.Errorf("Error: %v hash is missing parameter %q", p.id, name)
+	}
+	return v, nil
+}
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32 //in KiB
+	threads uint8
+}
+
+//NewArgon2idHasher returns a hasher for argon2id, which is what the manager uses unless it's told
+//otherwise. memory is in KiB. The default is 2 passes over 19 MiB with 1 thread
+func NewArgon2idHasher(time, memory uint32, threads uint8) (*argon2idHasher, error) {
+	if time < 1 || memory < 8*uint32(threads) || threads < 1 {
+		return nil, fmt.Errorf("Error: argon2id needs at least 1 pass, 1 thread and 8 KiB of memory per thread")
+	}
+	if time > maxPasswordPasses || uint64(memory)*1024 > maxPasswordMemory {
+		return nil, fmt.Errorf("Error: argon2id can use at most %v passes and %v KiB of memory", maxPasswordPasses, maxPasswordMemory/1024)
+	}
+	return &argon2idHasher{time: time, memory: memory, threads: threads}, nil
+}
+
+func (h *argon2idHasher) ID() string { return HasherArgon2id }
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, passwordKeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time, h.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, err := parsePHC(encoded)
+	if err != nil {
+		return false, err
+	}
+	if p.id != HasherArgon2id || p.version != argon2.Version {
+		return false, fmt.Errorf("Error: not an argon2id hash of version %v", argon2.Version)
+	}
+	m, err := p.param("m")
+	if err != nil {
+		return false, err
+	}
+	t, err := p.param("t")
+	if err != nil {
+		return false, err
+	}
+	threads, err := p.param("p")
+	if err != nil {
+		return false, err
+	}
+	if threads > 255 {
+		return false, fmt.Errorf("Error: argon2id can't use %v threads", threads)
+	}
+	if t > maxPasswordPasses || m > maxPasswordMemory/1024 {
+		return false, fmt.Errorf("Error: argon2id hash asks for too much work (m=%v, t=%v)", m, t)
+	}
+	key := argon2.IDKey([]byte(password), p.salt, uint32(t), uint32(m), uint8(threads), uint32(len(p.hash)))
+	return subtle.ConstantTimeCompare(key, p.hash) == 1, nil
+}
+
+type scryptHasher struct {
+	logN int //N is 2 to the power of this
+	r    int
+	p    int
+}
+
+//NewScryptHasher returns a hasher for scrypt. N is 2 to the power of logN, and the memory it
+//uses is about 128 * N * r bytes. The default is a logN of 15 with r 8 and p 1, or 32 MiB
+func NewScryptHasher(logN, r, p int) (*scryptHasher, error) {
+	if logN < 1 || logN > 30 || r < 1 || p < 1 {
+		return nil, fmt.Errorf("Error: scrypt needs a logN between 1 and 30, and r and p of at least 1")
+	}
+	if scryptTooBig(logN, r, p) {
+		return nil, fmt.Errorf("Error: scrypt can use at most %v bytes of memory and a p of %v", maxPasswordMemory, maxPasswordPasses)
+	}
+	return &scryptHasher{logN: logN, r: r, p: p}, nil
+}
+
+func (h *scryptHasher) ID() string { return HasherScrypt }
+
+func (h *scryptHasher) Hash(password string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.logN, h.r, h.p, passwordKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.logN, h.r, h.p, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *scryptHasher) Verify(password, encoded string) (bool, error) {
+	p, err := parsePHC(encoded)
+	if err != nil {
+		return false, err
+	}
+	if p.id != HasherScrypt {
+		return false, fmt.Errorf("Error: not an scrypt hash")
+	}
+	ln, err := p.param("ln")
+	if err != nil {
+		return false, err
+	}
+	r, err := p.param("r")
+	if err != nil {
+		return false, err
+	}
+	par, err := p.param("p")
+	if err != nil {
+		return false, err
+	}
+	if ln > 30 {
+		return false, fmt.Errorf("Error: scrypt logN of %v is too big", ln)
+	}
+	if scryptTooBig(ln, r, par) {
+		return false, fmt.Errorf("Error: scrypt hash asks for too much work (ln=%v, r=%v, p=%v)", ln, r, par)
+	}
+	key, err := scrypt.Key([]byte(password), p.salt, 1<<ln, r, par, len(p.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, p.hash) == 1, nil
+}
+
+//scryptTooBig says if scrypt with these settings would go over the limits. r is checked on its own
+//first so that the multiplication can't overflow
+func scryptTooBig(logN, r, p int) bool {
+	return p > maxPasswordPasses || r > maxPasswordMemory/128 || 128*r > maxPasswordMemory>>logN
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+//NewBcryptHasher returns a hasher for bcrypt. bcrypt only looks at the first 72 bytes of a
+//password, which is why it isn't the default anymore
+func NewBcryptHasher(cost int) (*bcryptHasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("Error: bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return &bcryptHasher{cost: cost}, nil
+}
+
+func (h *bcryptHasher) ID() string { return HasherBcrypt }
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type pbkdf2Hasher struct {
+	iterations int
+}
+
+//NewPBKDF2Hasher returns a hasher for PBKDF2 with SHA-256, for when something like FIPS says it's
+//the only one you can use. The default is 600,000 iterations
+func NewPBKDF2Hasher(iterations int) (*pbkdf2Hasher, error) {
+	if iterations < 1 || iterations > maxPBKDF2Rounds {
+		return nil, fmt.Errorf("Error: PBKDF2 needs between 1 and %v iterations", maxPBKDF2Rounds)
+	}
+	return &pbkdf2Hasher{iterations: iterations}, nil
+}
+
+func (h *pbkdf2Hasher) ID() string { return HasherPBKDF2 }
+
+func (h *pbkdf2Hasher) Hash(password string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, h.iterations, passwordKeyLength, sha256.New)
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", h.iterations, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *pbkdf2Hasher) Verify(password, encoded string) (bool, error) {
+	p, err := parsePHC(encoded)
+	if err != nil {
+		return false, err
+	}
+	if p.id != HasherPBKDF2 {
+		return false, fmt.Errorf("Error: not a PBKDF2-SHA256 hash")
+	}
+	i, err := p.param("i")
+	if err != nil {
+		return false, err
+	}
+	if i > maxPBKDF2Rounds {
+		return false, fmt.Errorf("Error: PBKDF2 hash asks for too many iterations (%v)", i)
+	}
+	key := pbkdf2.Key([]byte(password), p.salt, i, len(p.hash), sha256.New)
+	return subtle.ConstantTimeCompare(key, p.hash) == 1, nil
+}
+
+//defaultHasher returns one of the built in hashers with its default settings. bcrypt takes its
+//cost from the manager's hash strength, like it always has
+func defaultHasher(name string, hashStrength int) (PasswordHasher, error) {
+	switch name {
+	case HasherArgon2id:
+		return NewArgon2idHasher(2, 19*1024, 1)
+	case HasherScrypt:
+		return NewScryptHasher(15, 8, 1)
+	case HasherBcrypt:
+		if hashStrength < bcrypt.MinCost {
+			hashStrength = bcrypt.MinCost
+		}
+		return NewBcryptHasher(hashStrength)
+	case HasherPBKDF2:
+		return NewPBKDF2Hasher(600000)
+	}
+	return nil, fmt.Errorf("Error: password hasher %q not supported", name)
+}
+
+//hashID reads which hasher made a hash. bcrypt hashes start with "$2a$", "$2b$" or "$2y$"
+func hashID(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	switch parts[1] {
+	case "2", "2a", "2b", "2x", "2y":
+		return HasherBcrypt
+	}
+	return parts[1]
+}
+
+//SetPasswordHasher makes h the hasher Hash uses, so it can be one of the built in hashers with
+//different settings, or one of your own. CheckPassword keeps checking hashes from any hasher the
+//manager has been given, so old hashes still work after a change
+func (mng *sessionManager) SetPasswordHasher(h PasswordHasher) {
+	mng.mux.Lock()
+	mng.passwordHasher = h
+	mng.passwordHashers[h.ID()] = h
+	mng.encryptionType = h.ID()
+	mng.mux.Unlock()
+}
+
+//getPasswordHasher returns the hasher Hash uses
+func (mng *sessionManager) getPasswordHasher() (PasswordHasher, error) {
+	mng.mux.RLock()
+	h, name, hashStrength := mng.passwordHasher, mng.encryptionType, mng.hashStrength
+	mng.mux.RUnlock()
+	if h != nil && h.ID() == name {
+		return h, nil
+	}
+	return defaultHasher(name, hashStrength)
+}
+
+//hasherFor returns the hasher that can check a hash, going by the name at the start of it
+func (mng *sessionManager) hasherFor(encoded string) (PasswordHasher, error) {
+	id := hashID(encoded)
+	mng.mux.RLock()
+	h, ok := mng.passwordHashers[id]
+	mng.mux.RUnlock()
+	if ok {
+		return h, nil
+	}
+	return defaultHasher(id, bcrypt.MinCost) //the settings are in the hash, so the defaults don't matter here
+}
@@ -0,0 +1,166 @@
+package biscuit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+//this file is for the performance cookie, which keeps anonymous analytics about a browser: a
+//visitor ID that has nothing to do with any user or session, when the visitor was first and last
+//seen, and how many visits they've made. Analytics cookies need the user's say-so in a lot of
+//places, so nothing here sets a cookie unless the user has consented to analytics
+
+var defaultVisitTimeout = 30 * time.Minute //a request after this much quiet counts as a new visit
+
+var defaultPerformanceMaxAge int = 60 * 60 * 24 * 365
+
+var maxBeaconSize int64 = 64 << 10
+
+//ErrNoConsent is returned instead of setting a cookie the user hasn't agreed to
+var ErrNoConsent = errors.New("Error: no consent for this kind of cookie")
+
+//Visitor is what the performance cookie remembers about a browser
+type Visitor struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first"`
+	LastSeen  time.Time `json:"last"`
+	Visits    int       `json:"visits"`
+}
+
+//Beacon is a report of how long a page took to load, sent by the browser with something like
+//navigator.sendBeacon. Timings are in milliseconds, keyed by whatever the page measured, like
+//"ttfb" or "lcp"
+type Beacon struct {
+	VisitorID string             `json:"-"`
+	Page      string             `json:"page"`
+	Timings   map[string]float64 `json:"timings"`
+	Received  time.Time          `json:"-"`
+}
+
+//SetAnalyticsConsent sets the function the session manager asks before it sets or reads a
+//performance cookie, for apps that keep track of consent themselves. It should report whether
+//the user behind the request has agreed to analytics. Until this is called, the answer comes
+//from the consent cookie, which says no until the user says yes
+func (mng *sessionManager) SetAnalyticsConsent(f func(r *http.Request) bool) {
+	mng.mux.Lock()
+	mng.analyticsConsent = f
+	mng.mux.Unlock()
+}
+
+//analyticsAllowed asks the consent function about a request
+func (mng *sessionManager) analyticsAllowed(r *http.Request) bool {
+	mng.mux.RLock()
+	f := mng.analyticsConsent
+	mng.mux.RUnlock()
+	if f == nil {
+		return mng.GetConsent(r).Allowed(ConsentAnalytics)
+	}
+	return f(r)
+}
+
+//GetVisitor reads the performance cookie without changing it. It returns nil and no error if
+//the browser hasn't been seen before
+func (mng *sessionManager) GetVisitor(r *http.Request) (*Visitor, error) {
+	if err := mng.enter(); err != nil {
+		return nil, err
+	}
+	defer mng.leave()
+	if mng.analyticsAllowed(r) != true {
+		return nil, ErrNoConsent
+	}
+	return mng.readVisitor(r), nil
+}
+
+//readVisitor decodes the performance cookie. A cookie that's missing, unsigned, or mangled is
+//treated like a brand new visitor instead of an error, since there's nothing the user could do
+//about it anyway
+func (mng *sessionManager) readVisitor(r *http.Request) *Visitor {
+	c, err := r.Cookie(mng.PerformanceCookie())
+	if err != nil {
+		return nil
+	}
+	value, _, err := mng.getKeyring().verify(c.Name, c.Value)
+	if err != nil {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	v := &Visitor{}
+	if json.Unmarshal(data, v) != nil || v.ID == "" {
+		return nil
+	}
+	return v
+}
+
+//TrackVisit records a request in the performance cookie: a new visitor gets an ID, and anyone
+//coming back after 30 minutes away has their visit count go up. It returns the visitor as it
+//stands after this request, or ErrNoConsent without setting anything
+func (mng *sessionManager) TrackVisit(w http.ResponseWriter, r *http.Request) (*Visitor, error) {
+	if err := mng.enter(); err != nil {
+		return nil, err
+	}
+	defer mng.leave()
+	if mng.analyticsAllowed(r) != true {
+		return nil, ErrNoConsent
+	}
+	now := time.Now()
+	v := mng.readVisitor(r)
+	if v == nil {
+		id, err := (&randomIDGenerator{length: minIDLength, encoding: EncodingBase64URL}).NewID()
+		if err != nil {
+			return nil, err
+		}
+		v = &Visitor{ID: id, FirstSeen: now, Visits: 1}
+	} else if now.Sub(v.LastSeen) > defaultVisitTimeout {
+		v.Visits++
+	}
+	v.LastSeen = now
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	c := mng.newCookie(mng.names().Performance, "", defaultPerformanceMaxAge)
+	c.Value = mng.getKeyring().sign(c.Name, base64.RawURLEncoding.EncodeToString(data), now)
+	return v, mng.writeCookie(w, c)
+}
+
+//BeaconHandler returns a handler for the page timing beacons browsers send. Each beacon is
+//decoded, tagged with the visitor's ID, and passed to record, which can store it wherever it
+//likes. Beacons from browsers without consent are dropped. The handler always answers 204, or
+//an error status if the beacon is malformed or the manager is closed, since browsers don't look
+//at the answer anyway
+func (mng *sessionManager) BeaconHandler(record func(b *Beacon)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := mng.enter(); err != nil {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer mng.leave()
+		if mng.analyticsAllowed(r) != true {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		b := &Beacon{}
+		body := io.LimitReader(r.Body, maxBeaconSize)
+		if err := json.NewDecoder(body).Decode(b); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if v := mng.readVisitor(r); v != nil {
+			b.VisitorID = v.ID
+		}
+		b.Received = time.Now()
+		record(b)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,159 @@
+package biscuit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//this file is for the preferences cookie, which holds things like a theme or a language that
+//the page's own JavaScript might want to read. The value is base64url encoded JSON, wrapped in
+//a small envelope with a version number so the shape of the preferences can change over time:
+//
+//	base64url({"v":2,"d":{"theme":"dark"}})
+//
+//If the cookie is signed, the signature goes after it like any other signed cookie, so JS can
+//still read the part before the first "|"
+
+var defaultPreferenceMaxAge int = 60 * 60 * 24 * 365 //preferences stick around for a year
+
+//PreferenceOptions decide how the preferences cookie is written
+type PreferenceOptions struct {
+	Version  int  //the version of your preferences type. Bump it when the type changes, and add a migration from the old one
+	Signed   bool //sign the cookie, so the server can trust what it reads back
+	JSAccess bool //leave HttpOnly off, so the page's JavaScript can read the cookie
+	MaxAge   int  //in seconds. 0 uses the default of a year
+}
+
+//PreferenceMigration turns preferences saved under one version into the next version up
+type PreferenceMigration func(old json.RawMessage) (json.RawMessage, error)
+
+//preferenceEnvelope is what actually gets encoded into the cookie
+type preferenceEnvelope struct {
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"d"`
+}
+
+//SetPreferenceOptions changes how the preferences cookie is written
+func (mng *sessionManager) SetPreferenceOptions(o PreferenceOptions) error {
+	if o.Version < 0 || o.MaxAge < 0 {
+		return fmt.Errorf("Error: preference version and max age can't be negative")
+	}
+	if o.MaxAge == 0 {
+		o.MaxAge = defaultPreferenceMaxAge
+	}
+	mng.mux.Lock()
+	mng.preferenceOptions = o
+	mng.mux.Unlock()
+	return nil
+}
+
+//AddPreferenceMigration registers the function that upgrades preferences saved under version
+//from to version from+1. When GetPreferences reads an old cookie, it runs every migration between
+//the cookie's version and the current one, in order
+func (mng *sessionManager) AddPreferenceMigration(from int, m PreferenceMigration) {
+	mng.mux.Lock()
+	mng.preferenceMigrations[from] = m
+	mng.mux.Unlock()
+}
+
+//SetPreferences encodes v as JSON and stores it in the preferences cookie. It returns
+//ErrCookieTooLarge instead of writing a cookie the browser would throw away, and ErrNoConsent
+//without writing anything if the user hasn't agreed to preference cookies
+func (mng *sessionManager) SetPreferences(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	if mng.GetConsent(r).Allowed(ConsentPreferences) != true {
+		return ErrNoConsent
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	mng.mux.RLock()
+	o := mng.preferenceOptions
+	mng.mux.RUnlock()
+	env, err := json.Marshal(&preferenceEnvelope{Version: o.Version, Data: data})
+	if err != nil {
+		return err
+	}
+	c := mng.newCookie(mng.names().Preference, base64.RawURLEncoding.EncodeToString(env), o.MaxAge)
+	if o.Signed {
+		c.Value = mng.getKeyring().sign(c.Name, c.Value, time.Now())
+	}
+	if len(c.Name)+len(c.Value)+1 > maxCookieSize {
+		return ErrCookieTooLarge
+	}
+	c.HttpOnly = o.JSAccess != true
+	return mng.writeCookie(w, c)
+}
+
+//GetPreferences decodes the preferences cookie into v, which should be a pointer, migrating it
+//up to the current version first if it's old. If the manager signs preferences, an unsigned or
+//tampered cookie returns ErrInvalidSignature. Without consent to preference cookies, it returns
+//ErrNoConsent, even if there's an old cookie lying around
+func (mng *sessionManager) GetPreferences(r *http.Request, v interface{}) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	if mng.GetConsent(r).Allowed(ConsentPreferences) != true {
+		return ErrNoConsent
+	}
+	c, err := r.Cookie(mng.PreferenceCookie())
+	if err != nil {
+		return err
+	}
+	mng.mux.RLock()
+	o := mng.preferenceOptions
+	mng.mux.RUnlock()
+	value := c.Value
+	if o.Signed {
+		value, _, err = mng.getKeyring().verify(c.Name, c.Value)
+		if err != nil {
+			return err
+		}
+	} else if i := strings.IndexByte(value, '|'); i >= 0 {
+		value = value[:i] //it was signed before signing was turned off
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("Error: preferences cookie is not base64url: %v", err)
+	}
+	env := &preferenceEnvelope{}
+	if err := json.Unmarshal(raw, env); err != nil {
+		return err
+	}
+	data, err := mng.migratePreferences(env, o.Version)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+//migratePreferences runs the migrations that take env up to version
+func (mng *sessionManager) migratePreferences(env *preferenceEnvelope, version int) (json.RawMessage, error) {
+	if env.Version > version {
+		return nil, fmt.Errorf("Error: preferences are version %v, which is newer than %v", env.Version, version)
+	}
+	data := env.Data
+	for from := env.Version; from < version; from++ {
+		mng.mux.RLock()
+		m, ok := mng.preferenceMigrations[from]
+		mng.mux.RUnlock()
+		if ok != true {
+			return nil, fmt.Errorf("Error: no migration for preferences version %v", from)
+		}
+		var err error
+		data, err = m(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,525 @@
+package biscuit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//this file is for the Redis session store. It speaks RESP, the Redis protocol, directly, so
+//anything that understands RESP (Redis, KeyDB, Valkey, Dragonfly...) can hold the sessions for
+//every server in a cluster. Each session is stored under its own key as JSON, with its login
+//attempts in a second key so they can be bumped with INCR, and the last time it was seen in a
+//third, so Touch never has to write the whole session back over a change from another server
+
+var defaultRedisPoolSize int = 8
+
+var defaultRedisTimeout = 5 * time.Second
+
+var defaultRedisPrefix string = "biscuit:"
+
+//expiringStore is implemented by stores that can expire sessions on their own. The session
+//manager hands them how long a session can go without being written or touched, whenever its
+//session length or idle timeout changes
+type expiringStore interface {
+	SetTTL(d time.Duration)
+}
+
+//respError is an error reply from the server, like "-ERR unknown command"
+type respError string
+
+func (err respError) Error() string {
+	return "Redis error: " + string(err)
+}
+
+//respConn is a single connection to the server
+type respConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+//do sends one command and reads its reply. Replies come back as string (simple strings),
+//int64 (integers), []byte (bulk strings), nil (null bulk strings and arrays), []interface{}
+//(arrays), or a respError
+func (c *respConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(defaultRedisTimeout))
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(c.rd)
+}
+
+//readRESP reads a single RESP value from rd
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Error: malformed RESP line %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i], err = readRESP(rd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("Error: unknown RESP type %q", kind)
+	}
+}
+
+//redisStore keeps a small pool of connections to the server. A connection that hits a
+//network error is thrown away instead of going back in the pool
+type redisStore struct {
+	addr     string
+	password string
+	mux      sync.RWMutex //guards prefix and ttl, which can change while the store is in use
+	prefix   string
+	ttl      time.Duration
+	pool     chan *respConn
+}
+
+//NewRedisStore connects to the RESP server at addr, sending AUTH first if password isn't
+//empty. Keys are prefixed with "biscuit:" unless SetKeyPrefix says otherwise
+func NewRedisStore(addr, password string) (*redisStore, error) {
+	s := &redisStore{
+		addr:     addr,
+		password: password,
+		prefix:   defaultRedisPrefix,
+		pool:     make(chan *respConn, defaultRedisPoolSize),
+	}
+	if _, err := s.do("PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//SetKeyPrefix changes the prefix put in front of every key the store uses, so that more
+//than one session manager can share a server
+func (s *redisStore) SetKeyPrefix(prefix string) {
+	s.mux.Lock()
+	s.prefix = prefix
+	s.mux.Unlock()
+}
+
+//SetTTL sets how long a session lives in the store after it's last written or touched. Zero
+//means sessions never expire on their own. The session manager calls this with the shorter of
+//its session length and idle timeout, leaving out whichever is 0, so with neither set sessions
+//stay in the store until they're deleted
+func (s *redisStore) SetTTL(d time.Duration) {
+	s.mux.Lock()
+	s.ttl = d
+	s.mux.Unlock()
+}
+
+//getPrefix returns the store's key prefix
+func (s *redisStore) getPrefix() string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.prefix
+}
+
+//getTTL returns the store's TTL
+func (s *redisStore) getTTL() time.Duration {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.ttl
+}
+
+//dial opens a new connection and authenticates it
+func (s *redisStore) dial() (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, defaultRedisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{conn: conn, rd: bufio.NewReader(conn)}
+	if s.password != "" {
+		reply, err := c.do("AUTH", s.password)
+		if err == nil {
+			err = replyErr(reply)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//get takes a connection from the pool, or dials a new one if the pool is empty
+func (s *redisStore) get() (*respConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+		return s.dial()
+	}
+}
+
+//put returns a connection to the pool, closing it if the pool is full
+func (s *redisStore) put(c *respConn) {
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+//replyErr turns an error reply into a Go error
+func replyErr(reply interface{}) error {
+	if err, ok := reply.(respError); ok {
+		return err
+	}
+	return nil
+}
+
+//do runs a single command on a pooled connection
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	s.put(c)
+	return reply, replyErr(reply)
+}
+
+//multi runs every command inside of MULTI/EXEC, so they're applied all at once or not at all.
+//It returns the reply to each command
+func (s *redisStore) multi(cmds ...[]string) ([]interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) ([]interface{}, error) {
+		c.conn.Close()
+		return nil, err
+	}
+	if _, err := c.do("MULTI"); err != nil {
+		return fail(err)
+	}
+	for _, cmd := range cmds {
+		reply, err := c.do(cmd...)
+		if err != nil {
+			return fail(err)
+		}
+		if err := replyErr(reply); err != nil {
+			c.do("DISCARD")
+			s.put(c)
+			return nil, err
+		}
+	}
+	reply, err := c.do("EXEC")
+	if err != nil {
+		return fail(err)
+	}
+	s.put(c)
+	if err := replyErr(reply); err != nil {
+		return nil, err
+	}
+	results, _ := reply.([]interface{})
+	for _, result := range results {
+		if err := replyErr(result); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+//Close closes every pooled connection
+func (s *redisStore) Close() error {
+	for {
+		select {
+		case c := <-s.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *redisStore) sessionKey(id string) string {
+	return s.getPrefix() + "session:" + id
+}
+
+func (s *redisStore) attemptsKey(id string) string {
+	return s.getPrefix() + "attempts:" + id
+}
+
+func (s *redisStore) lastSeenKey(id string) string {
+	return s.getPrefix() + "lastseen:" + id
+}
+
+func (s *redisStore) userKey(username string) string {
+	return s.getPrefix() + "user:" + username
+}
+
+//expiry returns the extra SET arguments for a TTL, if there is one
+func expiry(ttl time.Duration) []string {
+	if ttl <= 0 {
+		return nil
+	}
+	return []string{"PX", strconv.FormatInt(ttl.Milliseconds(), 10)}
+}
+
+//Get returns the session with the given ID. Attempts and the last time it was seen live in their
+//own keys, so they're read along with it and folded into the record
+func (s *redisStore) Get(id string) (*SessionRecord, error) {
+	reply, err := s.do("MGET", s.sessionKey(id), s.attemptsKey(id), s.lastSeenKey(id))
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if ok != true || len(values) != 3 {
+		return nil, fmt.Errorf("Error: unexpected reply to MGET: %v", reply)
+	}
+	return decodeRedisRecord(values[0], values[1], values[2])
+}
+
+//decodeRedisRecord builds a record from the session, attempts and last seen values. The last seen
+//key only ever moves forward, so whichever of it and the record is later wins
+func decodeRedisRecord(session, attempts, lastSeen interface{}) (*SessionRecord, error) {
+	data, ok := session.([]byte)
+	if ok != true {
+		return nil, ErrSessionNotFound
+	}
+	rec := &SessionRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	if n, ok := attempts.([]byte); ok {
+		rec.Attempts, _ = strconv.Atoi(string(n))
+	}
+	if n, ok := lastSeen.([]byte); ok {
+		if nanos, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+			if t := fromUnixNano(nanos); t.After(rec.LastSeen) {
+				rec.LastSeen = t
+			}
+		}
+	}
+	return rec, nil
+}
+
+//Put writes the session, and adds it to its user's index, all in one transaction. The attempts
+//are only written if the session doesn't have any yet. After that they only change through
+//IncrAttempts and ResetAttempts, so a Put from one server can't undo another server's count
+func (s *redisStore) Put(rec *SessionRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ttl := s.getTTL()
+	cmds := [][]string{
+		append([]string{"SET", s.sessionKey(rec.ID), string(data)}, expiry(ttl)...),
+		append([]string{"SET", s.attemptsKey(rec.ID), strconv.Itoa(rec.Attempts), "NX"}, expiry(ttl)...),
+		{"SADD", s.userKey(rec.Username), rec.ID},
+	}
+	if ttl > 0 {
+		ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+		cmds = append(cmds,
+			[]string{"PEXPIRE", s.attemptsKey(rec.ID), ms}, //NX left it alone if it was already there
+			[]string{"PEXPIRE", s.lastSeenKey(rec.ID), ms},
+			[]string{"PEXPIRE", s.userKey(rec.Username), ms}, //the index only has to live as long as the newest session in it
+		)
+	}
+	_, err = s.multi(cmds...)
+	return err
+}
+
+//Delete removes a session, its attempts, and its entry in its user's index
+func (s *redisStore) Delete(id string) error {
+	rec, err := s.Get(id)
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.multi(
+		[]string{"DEL", s.sessionKey(id), s.attemptsKey(id), s.lastSeenKey(id)},
+		[]string{"SREM", s.userKey(rec.Username), id},
+	)
+	return err
+}
+
+//Touch updates the time a session was last seen. It only writes the last seen key, so it can't
+//undo a change another server just made to the session, and it pushes back when the session's
+//keys expire, since a session that's being used shouldn't idle out of the store
+func (s *redisStore) Touch(id string, t time.Time) error {
+	ttl := s.getTTL()
+	cmds := [][]string{
+		{"EXISTS", s.sessionKey(id)},
+		append([]string{"SET", s.lastSeenKey(id), strconv.FormatInt(toUnixNano(t), 10)}, expiry(ttl)...),
+	}
+	if ttl > 0 {
+		ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+		cmds = append(cmds,
+			[]string{"PEXPIRE", s.sessionKey(id), ms},
+			[]string{"PEXPIRE", s.attemptsKey(id), ms},
+		)
+	}
+	results, err := s.multi(cmds...)
+	if err != nil {
+		return err
+	}
+	if n, _ := results[0].(int64); n == 0 {
+		s.do("DEL", s.lastSeenKey(id)) //don't leave it lying around for a session that isn't there
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+//List walks the keyspace with SCAN, so it doesn't block the server the way KEYS would
+func (s *redisStore) List() ([]*SessionRecord, error) {
+	var recs []*SessionRecord
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", s.sessionKey("*"), "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if ok != true || len(page) != 2 {
+			return nil, fmt.Errorf("Error: unexpected reply to SCAN: %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			k, _ := key.([]byte)
+			rec, err := s.Get(strings.TrimPrefix(string(k), s.sessionKey("")))
+			if err == ErrSessionNotFound {
+				continue //expired while we were scanning
+			}
+			if err != nil {
+				return nil, err
+			}
+			recs = append(recs, rec)
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return recs, nil
+		}
+	}
+}
+
+//ListByUser returns every session in a user's index. Sessions that expired since they were added
+//to the index are skipped
+func (s *redisStore) ListByUser(username string) ([]*SessionRecord, error) {
+	reply, err := s.do("SMEMBERS", s.userKey(username))
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	var recs []*SessionRecord
+	for _, member := range members {
+		id, _ := member.([]byte)
+		rec, err := s.Get(string(id))
+		if err == ErrSessionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+//DeleteByUser removes every session in a user's index, and then the index itself
+func (s *redisStore) DeleteByUser(username string) error {
+	reply, err := s.do("SMEMBERS", s.userKey(username))
+	if err != nil {
+		return err
+	}
+	members, _ := reply.([]interface{})
+	args := []string{"DEL", s.userKey(username)}
+	for _, member := range members {
+		id, _ := member.([]byte)
+		args = append(args, s.sessionKey(string(id)), s.attemptsKey(string(id)), s.lastSeenKey(string(id)))
+	}
+	_, err = s.do(args...)
+	return err
+}
+
+//IncrAttempts bumps a session's login attempts with INCR, which the server runs atomically,
+//so every server in the cluster sees the same count. The check that the session exists goes in
+//the same transaction, so an INCR for a session that's gone can be spotted and cleaned up, and
+//the attempts are made to expire when the session does
+func (s *redisStore) IncrAttempts(id string) (int, error) {
+	results, err := s.multi(
+		[]string{"EXISTS", s.sessionKey(id)},
+		[]string{"INCR", s.attemptsKey(id)},
+		[]string{"PTTL", s.sessionKey(id)},
+	)
+	if err != nil {
+		return 0, err
+	}
+	if exists, _ := results[0].(int64); exists == 0 {
+		s.do("DEL", s.attemptsKey(id)) //the INCR just made it, and nothing would ever expire it
+		return 0, ErrSessionNotFound
+	}
+	n, ok := results[1].(int64)
+	if ok != true {
+		return 0, errors.New("Error: unexpected reply to INCR")
+	}
+	if ttl, _ := results[2].(int64); ttl > 0 {
+		if _, err := s.do("PEXPIRE", s.attemptsKey(id), strconv.FormatInt(ttl, 10)); err != nil {
+			return 0, err
+		}
+	}
+	return int(n), nil
+}
+
+//ResetAttempts sets a session's login attempts back to 0, if the session still has any
+func (s *redisStore) ResetAttempts(id string) error {
+	_, err := s.do("SET", s.attemptsKey(id), "0", "XX", "KEEPTTL")
+	return err
+}
@@ -0,0 +1,117 @@
+package biscuit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//this file is for rotating session IDs. An ID that was handed out before a user logged in, or
+//before their role changed, might have leaked to someone else (or been planted by them, which is
+//called session fixation), so whenever a session gains privileges it moves to a brand new ID and
+//the old one is retired
+
+//SetRotationGrace determines, in seconds, how long a session's old ID keeps working after it's
+//rotated with RotateSession. Requests that were already on their way with the old ID get the new
+//session instead of an error. 0, the default, retires the old ID right away. Login and SetRole
+//always retire it right away, since the old ID is exactly the one a session fixation attack
+//would have planted, and following it would hand the attacker the new privileges
+func (mng *sessionManager) SetRotationGrace(i int) {
+	mng.mux.Lock()
+	mng.rotationGrace = i
+	mng.mux.Unlock()
+}
+
+//RotateSession gives a session a new ID, carrying everything else over, and retires the old ID.
+//It returns the new ID, which needs to go out in a new session cookie
+func (mng *sessionManager) RotateSession(oldID string) (string, error) {
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	defer mng.lockSession(oldID)()
+	sess, err := mng.getSession(oldID)
+	if err != nil {
+		return "", err
+	}
+	if sess.cookieID != oldID {
+		return "", fmt.Errorf("Error: session %q has already been rotated", oldID)
+	}
+	return mng.rotate(sess, true)
+}
+
+//rotate saves a session under a new ID and retires its old one. If grace is true, the old ID
+//follows the session for the manager's grace window, otherwise it's gone straight away. The
+//caller has to hold the lock for the old ID. The new ID doesn't need locking, since nobody else
+//knows it yet
+func (mng *sessionManager) rotate(sess *session, grace bool) (string, error) {
+	oldID := sess.cookieID
+	newID, err := mng.newSessionID()
+	if err != nil {
+		return "", err
+	}
+	mng.mux.RLock()
+	window := mng.rotationGrace
+	mng.mux.RUnlock()
+	if grace != true {
+		window = 0
+	}
+	now := time.Now()
+
+	old := *sess
+	sess.cookieID = newID
+	sess.lastSeen = now
+	if err := mng.save(sess); err != nil {
+		return "", err
+	}
+	if sess.locked {
+		mng.lockout(sess) //the old ID's timer would only unlock the old ID
+	}
+
+	if mng.isStateless() {
+		//there's no store for the old cookie to point back to, so it's turned away outright
+		mng.revoke(&old)
+		return newID, mng.getStore().Delete(oldID)
+	}
+	if window <= 0 {
+		return newID, mng.getStore().Delete(oldID)
+	}
+	old.rotatedTo = newID
+	old.rotatedUntil = now.Add(time.Second * time.Duration(window))
+	return newID, mng.save(&old)
+}
+
+//reissue sets a new session cookie after a rotation, if there's somewhere to set it
+func (mng *sessionManager) reissue(w http.ResponseWriter, id string) error {
+	if w == nil {
+		return nil
+	}
+	return mng.setSessionCookie(w, id)
+}
+
+//SetRole changes a session's role. Since that usually means the session can do more than it
+//could before, the session is rotated like it is on Login, and the new ID is returned. If w isn't
+//nil, the new session cookie is set on it too. The old ID stops working right away
+func (mng *sessionManager) SetRole(w http.ResponseWriter, id, role string) (string, error) {
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	unlock := mng.lockSession(id)
+	sess, err := mng.getSession(id)
+	if err != nil {
+		unlock()
+		return "", err
+	}
+	if sess.cookieID != id {
+		unlock()
+		return "", fmt.Errorf("Error: session %q has already been rotated", id)
+	}
+	sess.role = role
+	newID, err := mng.rotate(sess, false)
+	unlock()
+	if err != nil {
+		return "", err
+	}
+	return newID, mng.reissue(w, newID)
+}
@@ -1,20 +1,29 @@
 package biscuit
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"sync"
 	"time"
+
+	"github.com/Jonny-Burkholder/biscuit/pkg/clientip"
 )
 
-var sessionCookieName string = "SESSbsct"
+var defaultSessionCookieName string = "SESSbsct"
+
+var defaultPreferenceCookieName string = "PREFbsct"
+
+var defaultPerformanceCookieName string = "PERFbsct" //I realize the similarity between "preference" and "performance" is confusing, I'll try to come up with better terms
 
-var preferenceCookieName string = "PREFbsct"
+var defaultConsentCookieName string = "CONSbsct"
 
-var performanceCookieName string = "PERFbsct" //I realize the similarity between "preference" and "performance" is confusing, I'll try to come up with better terms
+var defaultFlashCookieName string = "FLSHbsct"
 
 var defaultSessionLength int //should be set by user for each session manager, but if not, sessions will by default end when the browser is closed
 
@@ -22,14 +31,21 @@ var defautlLockoutTime int = 60 * 5 //by default locks user out for 5 minutes
 
 var defaultMaxLoginAttempts int = 5
 
-var defaultEncryptionType string = "bcrypt"
+var defaultIdleTimeout int = 0 //sessions never idle out unless SetIdleTimeout says so, which is how it's always been
+
+var defaultSweepInterval int = 60 //by default the janitor looks for expired sessions once a minute
+
+var defaultEncryptionType string = HasherArgon2id
 
 var defaultHashStrength int = 5
 
-var availableEncryptionTypes = []string{"bcrypt", "sha512", "md5"} //I'll add more later. I have to decide which ones I'll allow
+var availableEncryptionTypes = []string{HasherArgon2id, HasherScrypt, HasherBcrypt, HasherPBKDF2}
 
 var overseer map[string]*sessionManager
 
+//ErrManagerClosed is returned by any session manager call made after the manager has been closed
+var ErrManagerClosed = errors.New("Error: session manager is closed")
+
 //user is a generic interface to interact with 3rd party user types
 type user interface {
 	CreatePassword(string) error //a user must have a method to create a password that returns an error
@@ -48,67 +64,140 @@ func (user *myUser) CheckPassword(pswd string) error{
 }
 */
 
-//Session holds information about a user session. May depricate certain
-//fields in the future, instead using something like data interface{} for
-//user or other data
+//Session holds information about a user session. Anything beyond the user and
+//their role goes in data, see data.go
 type session struct {
-	mux       *sync.Mutex
-	username  string //not every session needs a user, need to update this
-	role      string
-	cookieID  string
-	ipAddress map[string]bool //false is blocked, while true is allowed
-	alive     bool
-	locked    bool
-	counter   *counter
+	username     string //not every session needs a user, need to update this
+	role         string
+	cookieID     string
+	ipAddress    map[string]bool //addresses and CIDRs. false is blocked, while true is allowed
+	alive        bool
+	locked       bool
+	lockedUntil  time.Time
+	counter      *counter
+	created      time.Time
+	lastSeen     time.Time
+	rotatedTo    string
+	rotatedUntil time.Time
+	flashes      []Flash
+	data         map[string][]byte //values encoded with the manager's codec
+	fingerprint  *Fingerprint      //the device the session was started on
 }
 
 //counter keeps track of login attempts and locks the user out if there are too many attempts
 type counter struct {
-	mux      *sync.Mutex
 	attempts int
 }
 
 //sessionManager is an in-memory struct that keeps track of
-//session data
+//session data. It's safe to use from as many goroutines as you like. mux guards the manager's
+//settings, while the sessions themselves are guarded by shards, keyed by session ID
 type sessionManager struct {
-	mux                  *sync.Mutex
+	mux                  sync.RWMutex
+	shards               []sync.Mutex
 	id                   string //the id is for if you're using multiple session managers, which I don't recommend. I might remove
 	unlockChan           chan string
 	killChan             chan bool
-	sessions             map[string]*session
-	users                map[string]user
+	store                SessionStore
 	data                 map[string]interface{} //for any data a program might need beyond sessions and users
 	sessionLength        int
 	maxUserLoginAttempts int
 	userLockoutTime      int
 	encryptionType       string
 	hashStrength         int
+	passwordHasher       PasswordHasher            //set by SetPasswordHasher, otherwise the built in one named by encryptionType
+	passwordHashers      map[string]PasswordHasher //every hasher given to SetPasswordHasher, for CheckPassword
+	idleTimeout          int
+	sweeper              *time.Ticker
+	doneChan             chan bool //closed once run() has returned
+	drainedChan          chan bool //closed once run() has returned and every call has left, after Close
+	closeMux             sync.RWMutex
+	closed               bool
+	storeClosed          bool
+	inFlight             sync.WaitGroup //calls that started before Close and haven't finished yet
+	lockoutMux           sync.Mutex
+	lockouts             map[string]*time.Timer
+	idGenerator          IDGenerator
+	keyring              *keyring
+	cipher               int
+	stateless            bool
+	rotationGrace        int
+	cookieOptions        CookieOptions
+	cookieNames          CookieNames
+	preferenceOptions    PreferenceOptions
+	preferenceMigrations map[int]PreferenceMigration
+	analyticsConsent     func(r *http.Request) bool
+	consentVersion       int
+	codec                Codec
+	limitMux             sync.Mutex //held while a new session is checked against its user's limit
+	maxSessionsPerUser   int
+	sessionLimitPolicy   int
+	fingerprintPolicy    int
+	ipResolver           *clientip.Resolver
+	ipv4Bits             int
+	ipv6Bits             int
+	blocklist            map[string]*net.IPNet //networks no session can be used from
+	revokedMux           sync.Mutex
+	revoked              map[string]time.Time //stateless sessions that were logged out, and when their cookies run out
 }
 
 //NewSessionManager is the basis of the user API. It takes no arguments, and
 //returns a pointer to a session manager struct. The session manager is automatically
-//running on creation
+//running on creation, and keeps running until Close is called
 func NewSessionManager() *sessionManager {
-	var mux *sync.Mutex
 	id := newMngID()
 	c := make(chan string)
 	mng := &sessionManager{
-		mux:                  mux,
+		shards:               make([]sync.Mutex, defaultShardCount),
 		id:                   id,
 		unlockChan:           c,
-		sessions:             make(map[string]*session),
-		users:                make(map[string]user),
+		killChan:             make(chan bool),
+		doneChan:             make(chan bool),
+		drainedChan:          make(chan bool),
+		lockouts:             make(map[string]*time.Timer),
+		revoked:              make(map[string]time.Time),
+		store:                NewMemoryStore(),
 		data:                 make(map[string]interface{}),
 		sessionLength:        defaultSessionLength,
 		maxUserLoginAttempts: defaultMaxLoginAttempts,
 		userLockoutTime:      defautlLockoutTime,
 		encryptionType:       defaultEncryptionType,
 		hashStrength:         defaultHashStrength,
+		passwordHashers:      make(map[string]PasswordHasher),
+		idleTimeout:          defaultIdleTimeout,
+		idGenerator:          &randomIDGenerator{length: defaultIDLength, encoding: EncodingBase64URL},
+		keyring:              newRandomKeyring(),
+		cipher:               defaultCipher,
+		cookieOptions:        defaultCookieOptions,
+		cookieNames:          CookieNames{defaultSessionCookieName, defaultPreferenceCookieName, defaultPerformanceCookieName, defaultConsentCookieName, defaultFlashCookieName},
+		preferenceOptions:    PreferenceOptions{MaxAge: defaultPreferenceMaxAge},
+		preferenceMigrations: make(map[int]PreferenceMigration),
+		codec:                JSONCodec,
+		ipResolver:           clientip.Default,
+		ipv4Bits:             defaultIPv4Bits,
+		ipv6Bits:             defaultIPv6Bits,
+		blocklist:            make(map[string]*net.IPNet),
+		sweeper:              time.NewTicker(time.Second * time.Duration(defaultSweepInterval)),
 	}
 	mng.run()
 	return mng
 }
 
+//managerSnapshot is the exported mirror of a session manager that Marshal and
+//LoadSessionManager use, since encoding/json can't see unexported fields
+type managerSnapshot struct {
+	ID                   string           `json:"id"`
+	SessionLength        int              `json:"sessionLength"`
+	IdleTimeout          int              `json:"idleTimeout"`
+	MaxUserLoginAttempts int              `json:"maxUserLoginAttempts"`
+	UserLockoutTime      int              `json:"userLockoutTime"`
+	EncryptionType       string           `json:"encryptionType"`
+	HashStrength         int              `json:"hashStrength"`
+	CookieNames          CookieNames      `json:"cookieNames"`
+	Blocklist            []string         `json:"blocklist,omitempty"`
+	Sessions             []*SessionRecord `json:"sessions"`
+}
+
 //LoadSessionManager takes a string argument "path", which points
 //to a json serialized session manager on disk. It then loads this
 //session manager into an in-memory struct, returning its pointer.
@@ -119,85 +208,366 @@ func LoadSessionManager(path string) (*sessionManager, error) {
 	if err != nil {
 		return nil, err
 	}
-	//will have to update this when we move things to
-	//
-	mng := &sessionManager{}
-	err = json.Unmarshal(f, mng)
+	snap := &managerSnapshot{}
+	err = json.Unmarshal(f, snap)
 	if err != nil {
 		return nil, err
 	}
-	return mng, err
+	store := NewMemoryStore()
+	for _, rec := range snap.Sessions {
+		store.Put(rec)
+	}
+	mng := NewSessionManager()
+	if snap.ID != "" {
+		mng.id = snap.ID
+	}
+	mng.mux.Lock()
+	mng.sessionLength = snap.SessionLength
+	mng.idleTimeout = snap.IdleTimeout
+	mng.maxUserLoginAttempts = snap.MaxUserLoginAttempts
+	mng.userLockoutTime = snap.UserLockoutTime
+	mng.hashStrength = snap.HashStrength
+	mng.mux.Unlock()
+	//older snapshots can say md5 or sha512, which are gone, and a hasher of your own has to be given
+	//to SetPasswordHasher again, so if the name isn't a built in hasher the default stays
+	mng.SetEncryptionType(snap.EncryptionType)
+	if err := mng.SetCookieNames(snap.CookieNames); err != nil { //older snapshots don't have names, so they get the defaults
+		return nil, err
+	}
+	for _, cidr := range snap.Blocklist {
+		if err := mng.BlockNetwork(cidr); err != nil {
+			return nil, err
+		}
+	}
+	if err := mng.SetStore(store); err != nil {
+		return nil, err
+	}
+	return mng, nil
 }
 
 //Marshal takes a session manager and marshals it to json for DB storage, if you're
-//into that sort of thing
+//into that sort of thing. Every session in the manager's store goes along with it. The keyring
+//doesn't, since secrets have no business sitting in a json file, so call SetKeyring on the
+//loaded manager or every cookie it signed before will be turned away
 func (mng *sessionManager) Marshal() ([]byte, error) {
-	//we'll need to manually change this to fill in the non-exported
-	//fields for the session manager
-	return json.Marshal(mng)
+	if err := mng.enter(); err != nil {
+		return nil, err
+	}
+	defer mng.leave()
+	recs, err := mng.getStore().List()
+	if err != nil {
+		return nil, err
+	}
+	blocklist := mng.Blocklist() //takes mux itself, and taking an RLock twice can deadlock with a writer waiting
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	return json.Marshal(&managerSnapshot{
+		ID:                   mng.id,
+		SessionLength:        mng.sessionLength,
+		IdleTimeout:          mng.idleTimeout,
+		MaxUserLoginAttempts: mng.maxUserLoginAttempts,
+		UserLockoutTime:      mng.userLockoutTime,
+		EncryptionType:       mng.encryptionType,
+		HashStrength:         mng.hashStrength,
+		CookieNames:          mng.cookieNames,
+		Blocklist:            blocklist,
+		Sessions:             recs,
+	})
 }
 
 //run() allows the session manager to listen asyncronously
 //on its various channels and perform tasks with them
 func (mng *sessionManager) run() {
 	go func() {
-		defer close(mng.unlockChan)
-		defer close(mng.killChan)
+		defer close(mng.doneChan)
 		for {
 			select {
 			case id := <-mng.unlockChan:
-				mng.sessions[id].locked = false
+				mng.unlock(id)
+			case <-mng.sweeper.C:
+				mng.sweep()
 			case <-mng.killChan:
+				mng.sweeper.Stop()
 				return
 			}
 		}
 	}()
 }
 
+//Close shuts the session manager down. It stops the manager's event loop, cancels any pending
+//lockout timers, waits for calls that are already underway to finish, and then closes the store
+//if the store has a Close method, which is how persistent stores get flushed to disk. Every call
+//made after Close starts returns ErrManagerClosed. If ctx is done before everything has drained,
+//Close gives up and returns ctx.Err() without closing the store, and calling Close again picks
+//up where it left off. Once the store is closed, Close returns ErrManagerClosed. Locked sessions
+//stay locked in the store, and pick their timers back up when the store is used again
+func (mng *sessionManager) Close(ctx context.Context) error {
+	mng.closeMux.Lock()
+	if mng.storeClosed {
+		mng.closeMux.Unlock()
+		return ErrManagerClosed
+	}
+	first := mng.closed != true
+	mng.closed = true
+	mng.closeMux.Unlock()
+
+	if first {
+		close(mng.killChan)
+		mng.lockoutMux.Lock()
+		for id, timer := range mng.lockouts {
+			timer.Stop()
+			delete(mng.lockouts, id)
+		}
+		mng.lockoutMux.Unlock()
+		go func() {
+			mng.inFlight.Wait()
+			<-mng.doneChan
+			close(mng.drainedChan)
+		}()
+	}
+	select {
+	case <-mng.drainedChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	mng.closeMux.Lock()
+	if mng.storeClosed {
+		mng.closeMux.Unlock()
+		return ErrManagerClosed //another Close got here first
+	}
+	mng.storeClosed = true
+	mng.closeMux.Unlock()
+	if closer, ok := mng.getStore().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+//enter marks the start of a call into the session manager, so that Close knows to wait
+//for it. It returns ErrManagerClosed once the manager has been closed. Every call to enter
+//that returns nil has to be matched with a call to leave
+func (mng *sessionManager) enter() error {
+	mng.closeMux.RLock()
+	defer mng.closeMux.RUnlock()
+	if mng.closed {
+		return ErrManagerClosed
+	}
+	mng.inFlight.Add(1)
+	return nil
+}
+
+//leave marks the end of a call started with enter
+func (mng *sessionManager) leave() {
+	mng.inFlight.Done()
+}
+
+//sweep is the session manager's janitor. It deletes every session that has expired, so
+//sessions nobody comes back for don't pile up in the store forever
+func (mng *sessionManager) sweep() {
+	mng.pruneRevoked(time.Now())
+	store := mng.getStore()
+	recs, err := store.List()
+	if err != nil {
+		return //we'll get it next time
+	}
+	now := time.Now()
+	for _, rec := range recs {
+		if mng.dead(rec, now) {
+			//check again under the lock, in case the session was used since we listed it
+			unlock := mng.lockSession(rec.ID)
+			latest, err := store.Get(rec.ID)
+			if err == nil && mng.dead(latest, now) {
+				store.Delete(rec.ID)
+			}
+			unlock()
+		}
+	}
+}
+
+//dead reports whether a session can be thrown away, either because it expired or because it
+//was rotated and the old ID's grace window is over
+func (mng *sessionManager) dead(rec *SessionRecord, now time.Time) bool {
+	if rec.RotatedTo != "" && now.After(rec.RotatedUntil) {
+		return true
+	}
+	return mng.expired(rec.Created, rec.LastSeen, now)
+}
+
+//expired reports whether a session created and last seen at the given times has run past
+//either the session length or the idle timeout. A length or timeout of 0 never expires
+func (mng *sessionManager) expired(created, lastSeen, now time.Time) bool {
+	mng.mux.RLock()
+	length, idle := mng.sessionLength, mng.idleTimeout
+	mng.mux.RUnlock()
+	if length > 0 && now.After(created.Add(time.Second*time.Duration(length))) {
+		return true
+	}
+	if idle > 0 && now.After(lastSeen.Add(time.Second*time.Duration(idle))) {
+		return true
+	}
+	return false
+}
+
+//unlock takes the lock off of a session once its lockout time is up
+func (mng *sessionManager) unlock(id string) {
+	defer mng.lockSession(id)()
+	sess, err := mng.getSession(id)
+	if err != nil {
+		return //the session is gone, so there's nothing left to unlock
+	}
+	sess.locked = false
+	sess.lockedUntil = time.Time{}
+	sess.counter.attempts = 0
+	if counter, ok := mng.getStore().(AttemptCounter); ok {
+		counter.ResetAttempts(id) //the store keeps the count to itself, so Put won't reset it
+	}
+	mng.save(sess)
+}
+
+//SetStore swaps out where the session manager keeps its sessions. By default every manager
+//uses an in-memory store, but any SessionStore will do. Sessions already in the old store
+//are not moved over to the new one. Any session in the new store that is still locked out
+//gets its lockout timer started back up
+func (mng *sessionManager) SetStore(store SessionStore) error {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	mng.mux.Lock()
+	mng.store = store
+	mng.mux.Unlock()
+	mng.syncStoreTTL()
+	return mng.resumeLockouts()
+}
+
+//getStore returns the store the session manager is currently using
+func (mng *sessionManager) getStore() SessionStore {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	return mng.store
+}
+
+//syncStoreTTL tells the store how long a session can go without being written or touched, if
+//it's a store that expires sessions on its own. That's the shorter of the session length and the
+//idle timeout, leaving out whichever is 0. The manager still checks both itself, the TTL is only
+//so the store cleans up after sessions nobody comes back for
+func (mng *sessionManager) syncStoreTTL() {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	store, ok := mng.store.(expiringStore)
+	if ok != true {
+		return
+	}
+	ttl := mng.sessionLength
+	if mng.idleTimeout > 0 && (ttl <= 0 || mng.idleTimeout < ttl) {
+		ttl = mng.idleTimeout
+	}
+	store.SetTTL(time.Second * time.Duration(ttl))
+}
+
+//resumeLockouts restarts the lockout timer for every locked session in the store. This
+//matters for stores that outlive the process, since the old timers died with it
+func (mng *sessionManager) resumeLockouts() error {
+	recs, err := mng.getStore().List()
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if rec.Locked {
+			mng.lockout(newSessionFromRecord(rec))
+		}
+	}
+	return nil
+}
+
 //SetSettionLength determines how long a session lasts in the session manager. The session manager
-//will use the same length of time for session cookies as well as the in-memory session handler
+//will use the same length of time for session cookies as well as the in-memory session handler.
+//Sessions expire this many seconds after they're created, no matter how active they are. 0 means
+//sessions only expire from the idle timeout
 func (mng *sessionManager) SetSessionLength(i int) {
+	mng.mux.Lock()
 	mng.sessionLength = i
+	mng.mux.Unlock()
+	mng.syncStoreTTL()
+}
+
+//SetIdleTimeout determines, in seconds, how long a session can go without being verified before
+//it expires. Every successful VerifySession pushes the timeout back again. 0 turns the idle
+//timeout off, leaving only the session length
+func (mng *sessionManager) SetIdleTimeout(i int) {
+	mng.mux.Lock()
+	mng.idleTimeout = i
+	mng.mux.Unlock()
+	mng.syncStoreTTL()
+}
+
+//SetSweepInterval determines, in seconds, how often the session manager looks through its
+//store for expired sessions to delete. Expired sessions are never let in either way, this
+//just decides how long they hang around taking up space
+func (mng *sessionManager) SetSweepInterval(i int) error {
+	if i < 1 {
+		return fmt.Errorf("Error: sweep interval must be greater than 0.")
+	}
+	mng.sweeper.Reset(time.Second * time.Duration(i))
+	return nil
+}
+
+//SetIDGenerator changes how the session manager makes new session IDs. By default they're 32
+//random bytes, base64url encoded. Sessions that already exist keep the IDs they have
+func (mng *sessionManager) SetIDGenerator(g IDGenerator) {
+	mng.mux.Lock()
+	mng.idGenerator = g
+	mng.mux.Unlock()
 }
 
 //SetMaxAttempts determines the maximum number of incorrect password attempts a user has before being
 //locked out of their account
 func (mng *sessionManager) SetMaxAttempts(i int) {
+	mng.mux.Lock()
 	mng.maxUserLoginAttempts = i
+	mng.mux.Unlock()
 }
 
 //SetLockoutTime determines, in seconds, how long a user will be locked out of their account for
 //reaching the maximimum number of login attempts
 func (mng *sessionManager) SetLockoutTime(i int) {
+	mng.mux.Lock()
 	mng.userLockoutTime = i
+	mng.mux.Unlock()
 }
 
-//SetEncryptionType sets which encryption type will be used by default in the session manager for
-//hashing passwords and other data
-//This eventually needs to be split into hashing and encryption as separate ideas within
-//the session manager, as we'll want to have both available. Also maybe I'll consider using
-//an int instead of a string, like with Rainman
+//SetEncryptionType sets which of the built in password hashers the session manager uses, with
+//its default settings: HasherArgon2id, HasherScrypt, HasherBcrypt or HasherPBKDF2. Use
+//SetPasswordHasher to change the settings, or to bring your own hasher
 func (mng *sessionManager) SetEncryptionType(s string) error {
 	for _, val := range availableEncryptionTypes {
 		if s == val {
+			mng.mux.Lock()
 			mng.encryptionType = val
+			mng.mux.Unlock()
+			return nil
 		}
 	}
 	return fmt.Errorf("Error: encryption type %q not supported", s)
 }
 
-//SetHashStrength changes the default hash strength for passwords hashed by the session manager.
-//Hash strength must be between 1 and 10. Why 10? Completely arbitrary. I'll update that with
-//an informed decision eventually
+//SetHashStrength changes the cost of bcrypt hashes made by the session manager, which can't go
+//below bcrypt's minimum of 4. Hash strength must be between 1 and 10. Why 10? Completely
+//arbitrary. The other hashers get their settings from their constructors instead
 func (mng *sessionManager) SetHashStrength(i int) error {
 	if i < 1 {
 		return fmt.Errorf("Error: hash strength must be greater than 0.")
 	} else if i > 10 {
 		i := i % 10
+		mng.mux.Lock()
 		mng.hashStrength = i
+		mng.mux.Unlock()
 		return fmt.Errorf("Maximum hash strength is 10. Hash strength set to %v.", i)
 	}
+	mng.mux.Lock()
 	mng.hashStrength = i
+	mng.mux.Unlock()
 	return nil
 }
 
@@ -207,9 +577,19 @@ func (mng *sessionManager) SetHashStrength(i int) error {
 //sure it makes any sense, I don't think that provides any security and it's probably just
 //a waste of time
 func (mng *sessionManager) NewSession(user string, r *http.Request, role ...string) (string, error) {
-	_, ok := mng.users[user]
-	if ok != false {
-		return "", fmt.Errorf("Invalid: user session %q already in progress", user)
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	mng.mux.RLock()
+	max, policy := mng.maxSessionsPerUser, mng.sessionLimitPolicy
+	mng.mux.RUnlock()
+	if max > 0 && user != "" {
+		mng.limitMux.Lock()
+		defer mng.limitMux.Unlock()
+		if err := mng.makeRoom(user, max, policy); err != nil {
+			return "", err
+		}
 	}
 
 	var userRole string
@@ -217,34 +597,103 @@ func (mng *sessionManager) NewSession(user string, r *http.Request, role ...stri
 	if len(role) > 0 {
 		userRole = role[0]
 	}
-	var mux *sync.Mutex
-	id := mng.newSessionID()
-	ip := getIP(r)
-	ipMap := make(map[string]bool)
-	ipMap[ip] = true
-	mng.sessions[id] = &session{
-		mux:       mux,
-		username:  user,
-		role:      userRole,
-		cookieID:  id,
-		ipAddress: ipMap,
-		alive:     false, //default to false, mostly to keep track of invalid login attempts
-		locked:    false,
-		counter:   newCounter(),
+	id, err := mng.newSessionID()
+	if err != nil {
+		return "", err
+	}
+	defer mng.lockSession(id)()
+	ip := clientip.Parse(mng.clientIP(r))
+	if ip == nil {
+		return "", ErrUnknownIP
+	}
+	if mng.blocked(ip) {
+		return "", errorUnauthorizedIP{IP: ip.String()}
+	}
+	ipMap := map[string]bool{mng.bindIP(ip): true}
+	now := time.Now()
+	sess := &session{
+		username:    user,
+		role:        userRole,
+		cookieID:    id,
+		ipAddress:   ipMap,
+		alive:       false, //default to false, mostly to keep track of invalid login attempts
+		locked:      false,
+		counter:     newCounter(),
+		created:     now,
+		lastSeen:    now,
+		fingerprint: NewFingerprint(r),
+	}
+	if err := mng.save(sess); err != nil {
+		return "", err
 	}
 	return id, nil
 }
 
+//save writes a session back to the session manager's store
+func (mng *sessionManager) save(sess *session) error {
+	return mng.getStore().Put(sess.record())
+}
+
+//record flattens a session into a SessionRecord so it can be handed to a SessionStore
+func (sess *session) record() *SessionRecord {
+	return &SessionRecord{
+		ID:           sess.cookieID,
+		Username:     sess.username,
+		Role:         sess.role,
+		IPAddress:    sess.ipAddress,
+		Alive:        sess.alive,
+		Locked:       sess.locked,
+		LockedUntil:  sess.lockedUntil,
+		Attempts:     sess.counter.attempts,
+		Created:      sess.created,
+		LastSeen:     sess.lastSeen,
+		RotatedTo:    sess.rotatedTo,
+		RotatedUntil: sess.rotatedUntil,
+		Flashes:      sess.flashes,
+		Data:         sess.data,
+		Fingerprint:  sess.fingerprint,
+	}
+}
+
+//newSessionFromRecord turns a SessionRecord from a SessionStore back into a session
+func newSessionFromRecord(rec *SessionRecord) *session {
+	c := newCounter()
+	c.attempts = rec.Attempts
+	ipMap := rec.IPAddress
+	if ipMap == nil {
+		ipMap = make(map[string]bool)
+	}
+	return &session{
+		username:     rec.Username,
+		role:         rec.Role,
+		cookieID:     rec.ID,
+		ipAddress:    ipMap,
+		alive:        rec.Alive,
+		locked:       rec.Locked,
+		lockedUntil:  rec.LockedUntil,
+		counter:      c,
+		created:      rec.Created,
+		lastSeen:     rec.LastSeen,
+		rotatedTo:    rec.RotatedTo,
+		rotatedUntil: rec.RotatedUntil,
+		flashes:      rec.Flashes,
+		data:         rec.Data,
+		fingerprint:  rec.Fingerprint,
+	}
+}
+
 func newCounter() *counter {
-	var mux sync.Mutex
-	return &counter{mux: &mux}
+	return &counter{}
 }
 
 //generates a new, unique ID for a session manager
 func newMngID() string {
+	g := &randomIDGenerator{length: minIDLength, encoding: EncodingHex}
 	for {
-		rand.Seed(time.Now().Unix())
-		id := fmt.Sprint(rand.Uint64())
+		id, err := g.NewID()
+		if err != nil {
+			panic(err) //crypto/rand doesn't fail on any platform Go supports
+		}
 		_, ok := overseer[id]
 		if ok != true {
 			return id
@@ -252,101 +701,225 @@ func newMngID() string {
 	}
 }
 
-//newSessionID generates a new random ID for a session
-//Currently this is not using what is considered a cryptographically
-//secure randomizer. I'll switch this to crypto.Rand()
-func (mng *sessionManager) newSessionID() string {
-	for {
-		rand.Seed(time.Now().Unix())
-		id := fmt.Sprint(rand.Uint64())
-		_, ok := mng.sessions[id]
-		if ok != true {
-			return id
+//maxIDTries is how many times newSessionID will try for an ID that isn't taken. With a
+//generator that has any real randomness in it, the first try is always the one
+var maxIDTries int = 3
+
+//newSessionID generates a new random ID for a session using the manager's IDGenerator
+func (mng *sessionManager) newSessionID() (string, error) {
+	mng.mux.RLock()
+	g := mng.idGenerator
+	mng.mux.RUnlock()
+	for i := 0; i < maxIDTries; i++ {
+		id, err := g.NewID()
+		if err != nil {
+			return "", err
+		}
+		_, err = mng.getStore().Get(id)
+		if err == ErrSessionNotFound {
+			return id, nil
+		}
+		if err != nil {
+			return "", err
 		}
 	}
+	return "", fmt.Errorf("Error: could not generate a unique session ID after %v tries", maxIDTries)
 }
 
-//addIP adds a new IP address to the session's ipAddress map, and sets its state
-//to true, indicating that it has not been blocked
-func (mng *sessionManager) addIP(sess *session, ip string) {
-	sess.ipAddress[ip] = true
-}
-
-//Login changes the bool in a user session so that the manager views the session as being "alive", or active
-func (mng *sessionManager) Login(id string) error {
-	sess, ok := mng.sessions[id]
-	if ok != true {
-		return fmt.Errorf("Error: session ID not found\n%q", id)
+//Login changes the bool in a user session so that the manager views the session as being "alive", or active.
+//The session gets a new ID at the same time, so that anyone who got hold of the ID before the user logged in
+//can't ride along on their login, and the new ID is returned. If w isn't nil, the new session cookie is set
+//on it too. The old ID stops working right away, whatever the rotation grace window is
+func (mng *sessionManager) Login(w http.ResponseWriter, id string) (string, error) {
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	unlock := mng.lockSession(id)
+	sess, err := mng.getSession(id)
+	if err != nil {
+		unlock()
+		return "", fmt.Errorf("Error: session ID not found\n%q", id)
+	}
+	if sess.cookieID != id {
+		unlock()
+		return "", fmt.Errorf("Error: session %q has already been rotated", id)
 	}
 	if sess.alive != false {
-		return fmt.Errorf("Error: user %q already logged in.", sess.username)
+		unlock()
+		return "", fmt.Errorf("Error: user %q already logged in.", sess.username)
 	}
 	sess.alive = true
-	return nil
-}
-
-//allowIP sets the state of a given IP address to true, indicating
-//that is is allowed
-func (mng *sessionManager) allowIP(sess *session, ip string) {
-	sess.ipAddress[ip] = true
-}
-
-//BlockIP sets the state of a given IP address to false, indicating
-//that it has been blocked
-func (mng *sessionManager) BlockIP(sess *session, ip string) {
-	sess.ipAddress[ip] = false
+	newID, err := mng.rotate(sess, false)
+	unlock()
+	if err != nil {
+		return "", err
+	}
+	return newID, mng.reissue(w, newID)
 }
 
 //Logout changes the session "alive" bool to false, so that the session
-//manager no longer considers the session to be active
+//manager no longer considers the session to be active. In stateless mode the
+//session is revoked too, so its cookie won't be accepted again
 func (mng *sessionManager) Logout(id string) error {
-	sess, ok := mng.sessions[id]
-	if ok != true {
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	unlock := mng.lockSession(id)
+	sess, err := mng.getSession(id)
+	if err == nil && sess.cookieID != id {
+		//logging out through an ID inside its grace window logs out the session it was rotated
+		//to, so that's the lock to hold, or a write to the new ID could put it back
+		unlock()
+		unlock = mng.lockSession(sess.cookieID)
+		sess, err = mng.getSession(sess.cookieID)
+	}
+	defer unlock()
+	if err != nil {
 		return fmt.Errorf("Error: session ID not found\n%q", id)
 	}
 	if sess.alive != true {
 		return fmt.Errorf("Error: user %q is not logged in.", sess.username)
 	}
 	sess.alive = false
+	if err := mng.save(sess); err != nil {
+		return err
+	}
+	if mng.isStateless() {
+		mng.revoke(sess) //the browser still has a cookie that says it's logged in
+	}
 	return nil
 }
 
 //CountUp increments the number of login attempts for a session, and locks the
-//session if the attempts reaches the maximum attempts allowed by the session manager
+//session if the attempts reaches the maximum attempts allowed by the session manager.
+//If the manager's store is an AttemptCounter, the increment happens in the store
 func (mng *sessionManager) CountUp(sess *session) error {
-	sess.counter.attempts++
-	if sess.counter.attempts == mng.maxUserLoginAttempts {
-		sess.locked = true
-		mng.lockout(sess)
-		return fmt.Errorf("Max attempts reached, locked out for %v minutes", mng.userLockoutTime/60)
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	defer mng.lockSession(sess.cookieID)()
+	latest, err := mng.getSession(sess.cookieID)
+	if err != nil {
+		return err
+	}
+	mng.mux.RLock()
+	maxAttempts, lockoutTime := mng.maxUserLoginAttempts, mng.userLockoutTime
+	mng.mux.RUnlock()
+
+	if counter, ok := mng.getStore().(AttemptCounter); ok {
+		attempts, err := counter.IncrAttempts(latest.cookieID)
+		if err != nil {
+			return err
+		}
+		latest.counter.attempts = attempts
+		if attempts != maxAttempts {
+			*sess = *latest
+			return nil //the store already has the new count, so there's nothing to save
+		}
+	} else {
+		latest.counter.attempts++
+	}
+	if latest.counter.attempts == maxAttempts {
+		latest.locked = true
+		latest.lockedUntil = time.Now().Add(time.Second * time.Duration(lockoutTime))
+		if err := mng.save(latest); err != nil {
+			return err
+		}
+		*sess = *latest
+		mng.lockout(latest)
+		if mng.isStateless() {
+			//the browser's cookie still says it isn't locked, and a server that hasn't seen
+			//the session would believe it, so the cookie is turned away until the lockout is up
+			mng.revokeUntil(latest.cookieID, latest.lockedUntil)
+		}
+		return fmt.Errorf("Max attempts reached, locked out for %v minutes", lockoutTime/60)
 	}
+	if err := mng.save(latest); err != nil {
+		return err
+	}
+	*sess = *latest
 	return nil
 }
 
-//Lockout locks out a user session for the time indicated by the session manager
+//Lockout locks out a user session for the time indicated by the session manager. The timer
+//is kept so that Close can cancel it
 func (mng *sessionManager) lockout(sess *session) {
-	go func() {
-		//should probably update this to a ticker
-		time.Sleep(time.Second * time.Duration(mng.userLockoutTime))
-		mng.unlockChan <- sess.cookieID
-	}()
+	id := sess.cookieID
+	mng.lockoutMux.Lock()
+	defer mng.lockoutMux.Unlock()
+	if old, ok := mng.lockouts[id]; ok {
+		old.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(sess.lockedUntil), func() {
+		mng.lockoutMux.Lock()
+		if mng.lockouts[id] == timer {
+			delete(mng.lockouts, id)
+		}
+		mng.lockoutMux.Unlock()
+		select {
+		case mng.unlockChan <- id:
+		case <-mng.killChan: //the manager closed, so there's nobody left to unlock it
+		}
+	})
+	mng.lockouts[id] = timer
 }
 
 //GetSession takes a session id and returns a pointer to a session and an error.
 //If the session is not found, a non-nil error will be returned. Typically the user
 //is retreiving this session ID from a request cookie value
 func (mng *sessionManager) GetSession(id string) (*session, error) {
-	sess, ok := mng.sessions[id]
-	if ok != true {
+	if err := mng.enter(); err != nil {
+		return &session{}, err
+	}
+	defer mng.leave()
+	return mng.getSession(id)
+}
+
+//getSession does the work for GetSession, and is what the session manager uses internally
+func (mng *sessionManager) getSession(id string) (*session, error) {
+	store := mng.getStore()
+	rec, err := store.Get(id)
+	if err == ErrSessionNotFound {
 		return &session{}, fmt.Errorf("Session %q not found", id)
 	}
-	return sess, nil
+	if err != nil {
+		return &session{}, err
+	}
+	if rec.RotatedTo != "" {
+		if time.Now().After(rec.RotatedUntil) {
+			store.Delete(id)
+			return &session{}, fmt.Errorf("Session %q has been replaced", id)
+		}
+		//the old ID still works for a little while, for requests that were already on their
+		//way when it was rotated, but they get the session it turned into
+		return mng.getSession(rec.RotatedTo)
+	}
+	if mng.expired(rec.Created, rec.LastSeen, time.Now()) {
+		store.Delete(id)
+		return &session{}, fmt.Errorf("Session %q has expired", id)
+	}
+	return newSessionFromRecord(rec), nil
+}
+
+//touch resets a session's idle timeout. It takes the session's lock so that the new time
+//can't be overwritten by a change that read the session before it
+func (mng *sessionManager) touch(id string) error {
+	defer mng.lockSession(id)()
+	return mng.getStore().Touch(id, time.Now())
 }
 
 //GetNameFromID takes as input a session ID from the session cookie, and returns the name from
 //the user session. Should be updated to more generically return user data from the session
 func (mng *sessionManager) GetNameFromID(id string) (string, error) {
-	sess, err := mng.GetSession(id)
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	sess, err := mng.getSession(id)
 	if err != nil {
 		return "", err
 	}
@@ -357,7 +930,11 @@ func (mng *sessionManager) GetNameFromID(id string) (string, error) {
 //role if found. If not found, it returns an empty string and a non-
 //nil error
 func (mng *sessionManager) GetRole(id string) (string, error) {
-	user, err := mng.GetSession(id)
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	user, err := mng.getSession(id)
 	if err != nil {
 		return "", err
 	}
@@ -381,17 +958,22 @@ func (mng *sessionManager) CheckRole(roles []string, id string) error {
 }
 
 //VerifySession takes a session id as an input and returns a non-nil
-//error if the session does not exist, or if the session's loggedIn
-//field is set to false
+//error if the session does not exist, has expired, or if the session's
+//loggedIn field is set to false. A session that passes has its idle
+//timeout reset
 func (mng *sessionManager) VerifySession(id string) error {
-	sess, err := mng.GetSession(id)
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	sess, err := mng.getSession(id)
 	if err != nil {
 		return err
 	}
 	if sess.alive != true {
 		return fmt.Errorf("User %v has a session, but is inactive", id)
 	}
-	return nil
+	return mng.touch(sess.cookieID)
 }
 
 //VerifySessionWithIP, like VerifySession, takes a session ID as input
@@ -399,12 +981,22 @@ func (mng *sessionManager) VerifySession(id string) error {
 //session's loggedIn bool is set to false. In addition, it returns a non-
 //nil error if the request IP address has been blocked by the session manager
 func (mng *sessionManager) VerifySessionWithIP(id string, r *http.Request) error {
-	sess, err := mng.GetSession(id)
+	if err := mng.enter(); err != nil {
+		return err
+	}
+	defer mng.leave()
+	sess, err := mng.getSession(id)
 	if err != nil {
 		return err
 	}
 	if sess.alive != true {
 		return fmt.Errorf("User %v has a session, but is inactive", id)
 	}
-	return mng.ValidateIP(r, sess)
+	if err := mng.checkFingerprint(sess, r); err != nil {
+		return err
+	}
+	if err := mng.validateIP(sess, r); err != nil {
+		return err
+	}
+	return mng.touch(sess.cookieID)
 }
@@ -0,0 +1,34 @@
+package biscuit
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+//this file is for spreading locks out over session IDs. Two requests for different sessions
+//almost never land on the same shard, so they don't have to wait on each other, while two
+//requests for the same session always do
+
+var defaultShardCount int = 64
+
+//shardFor picks which of n shards a session ID belongs to
+func shardFor(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
+
+//lockSession locks the shard a session ID belongs to, and returns the function that unlocks it.
+//Anything that reads a session, changes it, and writes it back has to hold this lock the whole
+//time, or two requests can each write back their own change and lose the other's
+func (mng *sessionManager) lockSession(id string) func() {
+	mux := &mng.shards[shardFor(id, len(mng.shards))]
+	mux.Lock()
+	return mux.Unlock
+}
+
+//memoryShard is one slice of a memoryStore
+type memoryShard struct {
+	mux      sync.RWMutex
+	sessions map[string]*SessionRecord
+}
@@ -0,0 +1,199 @@
+package biscuit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//this file is for signing cookies, so that nobody can hand us a cookie we didn't write. A signed
+//cookie looks like value|timestamp|mac, where the mac is an HMAC-SHA256 of the cookie's name,
+//value, and timestamp. Putting the name in the mac means a value signed for one cookie can't be
+//passed off as another
+
+var minKeyLength int = 32
+
+var defaultKeyID string = "default"
+
+//ErrInvalidSignature is returned when a cookie wasn't signed by any key in the keyring, or was
+//changed after it was signed
+var ErrInvalidSignature = errors.New("Error: invalid cookie signature")
+
+//ErrCookieExpired is returned when a signed cookie is older than the session length
+var ErrCookieExpired = errors.New("Error: cookie has expired")
+
+//keyring holds the keys a session manager signs cookies with. New cookies are always signed with
+//the active key, but a cookie signed with any key in the ring is accepted. To rotate secrets
+//without logging everyone out, add the new key, make it active, and then remove the old one
+//once every cookie signed with it has expired
+type keyring struct {
+	mux    sync.RWMutex
+	active string
+	keys   map[string][]byte
+}
+
+//NewKeyring returns a keyring with one key, which is the active key. Secrets have to be at least
+//32 bytes, and should come from somewhere like crypto/rand, not a password
+func NewKeyring(id string, secret []byte) (*keyring, error) {
+	k := &keyring{keys: make(map[string][]byte)}
+	if err := k.AddKey(id, secret); err != nil {
+		return nil, err
+	}
+	k.active = id
+	return k, nil
+}
+
+//newRandomKeyring is the keyring a session manager starts with. Since the key only lives in
+//memory, cookies stop working when the program restarts, and servers behind a load balancer
+//won't accept each other's cookies, so anything beyond a single server should call SetKeyring
+func newRandomKeyring() *keyring {
+	secret := make([]byte, minKeyLength)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err) //see newMngID
+	}
+	k, _ := NewKeyring(defaultKeyID, secret)
+	return k
+}
+
+//AddKey adds a key that cookies can be verified with. It doesn't sign anything until it's made
+//the active key
+func (k *keyring) AddKey(id string, secret []byte) error {
+	if id == "" || strings.ContainsAny(id, ".|") {
+		return fmt.Errorf("Error: key ID %q can't be empty or contain '.' or '|'", id) //encrypted values use the ID as a prefix
+	}
+	if len(secret) < minKeyLength {
+		return fmt.Errorf("Error: keys need at least %v bytes, got %v", minKeyLength, len(secret))
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("Error: key %q is already in the keyring", id)
+	}
+	k.keys[id] = append([]byte(nil), secret...)
+	return nil
+}
+
+//SetActive makes the key with the given ID the one new cookies are signed with
+func (k *keyring) SetActive(id string) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if _, ok := k.keys[id]; ok != true {
+		return fmt.Errorf("Error: key %q is not in the keyring", id)
+	}
+	k.active = id
+	return nil
+}
+
+//RemoveKey takes a key out of the keyring, after which cookies signed with it won't be accepted.
+//The active key can't be removed
+func (k *keyring) RemoveKey(id string) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if id == k.active {
+		return fmt.Errorf("Error: can't remove the active key %q", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+//mac signs the cookie name, value and timestamp with the given secret
+func mac(secret []byte, name, value, timestamp string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(name + "|" + value + "|" + timestamp))
+	return h.Sum(nil)
+}
+
+//sign returns value|timestamp|mac, signed with the active key
+func (k *keyring) sign(name, value string, now time.Time) string {
+	k.mux.RLock()
+	secret := k.keys[k.active]
+	k.mux.RUnlock()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return value + "|" + timestamp + "|" + base64.RawURLEncoding.EncodeToString(mac(secret, name, value, timestamp))
+}
+
+//verify checks a signed cookie value against every key in the ring, and returns the value and
+//the time it was signed
+func (k *keyring) verify(name, signed string) (string, time.Time, error) {
+	//the value itself might have a | in it, so split from the right
+	j := strings.LastIndexByte(signed, '|')
+	if j < 0 {
+		return "", time.Time{}, ErrInvalidSignature
+	}
+	i := strings.LastIndexByte(signed[:j], '|')
+	if i < 0 {
+		return "", time.Time{}, ErrInvalidSignature
+	}
+	value, timestamp := signed[:i], signed[i+1:j]
+	sum, err := base64.RawURLEncoding.DecodeString(signed[j+1:])
+	if err != nil {
+		return "", time.Time{}, ErrInvalidSignature
+	}
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	for _, secret := range k.keys {
+		if hmac.Equal(sum, mac(secret, name, value, timestamp)) {
+			unix, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return "", time.Time{}, ErrInvalidSignature
+			}
+			return value, time.Unix(unix, 0), nil
+		}
+	}
+	return "", time.Time{}, ErrInvalidSignature
+}
+
+//SetKeyring changes the keys the session manager signs and verifies cookies with. Every server
+//sharing sessions needs to use the same keys
+func (mng *sessionManager) SetKeyring(k *keyring) {
+	mng.mux.Lock()
+	mng.keyring = k
+	mng.mux.Unlock()
+}
+
+//getKeyring returns the keyring the session manager is currently using
+func (mng *sessionManager) getKeyring() *keyring {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	return mng.keyring
+}
+
+//VerifyCookie checks the signature on a cookie biscuit wrote, and returns the value that was signed.
+//The session cookie gets the same checks as ReadSessionCookie, and gives back the session ID. A
+//stateless session cookie that was split into chunks can't be read from its header alone, so
+//use ReadSessionCookie for those
+func (mng *sessionManager) VerifyCookie(c *http.Cookie) (string, error) {
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	if c.Name == mng.SessionCookie() {
+		return mng.readSessionCookie(c)
+	}
+	value, _, err := mng.getKeyring().verify(c.Name, c.Value)
+	return value, err
+}
+
+//ReadSessionCookie finds the session cookie on a request, checks its signature, and returns the
+//session ID in it. If the session manager has a session length, cookies older than that are
+//turned away too. It doesn't check the session itself, that's what VerifySession is for. In
+//stateless mode it decrypts the session and puts it in the store, so that VerifySession can
+func (mng *sessionManager) ReadSessionCookie(r *http.Request) (string, error) {
+	if err := mng.enter(); err != nil {
+		return "", err
+	}
+	defer mng.leave()
+	c, err := mng.readChunked(r, mng.SessionCookie()) //a stateless session can be split into chunks
+	if err != nil {
+		return "", err
+	}
+	return mng.readSessionCookie(c)
+}
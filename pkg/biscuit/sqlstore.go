@@ -0,0 +1,554 @@
+package biscuit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//this file is for the database/sql session store. biscuit doesn't import any database drivers
+//itself, so bring your own and hand the store an open *sql.DB
+
+//Dialect tells the SQL store which flavor of SQL it's talking to. Right now the only
+//difference that matters is how query placeholders are written
+type Dialect int
+
+const (
+	DialectSQLite   Dialect = iota //placeholders look like ?
+	DialectPostgres                //placeholders look like $1, $2, ...
+)
+
+//AttemptCounter is an optional interface for session stores that can bump a session's login
+//attempts in one atomic step. If the manager's store implements it, CountUp uses it instead of
+//reading, incrementing, and writing back the whole session, so lockouts still work when more
+//than one server shares the store. A store like that has to leave the count alone in Put, since
+//the record being put might have been read before another server's increment
+type AttemptCounter interface {
+	IncrAttempts(id string) (int, error) //returns the number of attempts after incrementing
+	ResetAttempts(id string) error       //sets the attempts back to 0 when a lockout is over
+}
+
+//sqlMigrations are run in order, and each one is only ever run once per database. Never
+//change one that's already been released, add a new one to the end instead
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		role TEXT NOT NULL,
+		alive BOOLEAN NOT NULL,
+		locked BOOLEAN NOT NULL,
+		locked_until BIGINT NOT NULL,
+		created BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS sessions_username ON sessions (username);
+	CREATE TABLE IF NOT EXISTS session_ips (
+		session_id TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		allowed BOOLEAN NOT NULL,
+		PRIMARY KEY (session_id, ip)
+	);
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		session_id TEXT PRIMARY KEY,
+		attempts INTEGER NOT NULL
+	);`,
+	`ALTER TABLE sessions ADD COLUMN rotated_to TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN rotated_until BIGINT NOT NULL DEFAULT 0;`,
+	`ALTER TABLE sessions ADD COLUMN flashes TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE sessions ADD COLUMN data TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE sessions ADD COLUMN fingerprint TEXT NOT NULL DEFAULT '';`,
+}
+
+//sqlStatements are prepared once when the store is created. They're all written with ?
+//placeholders and rebound for the store's dialect
+var sqlStatements = map[string]string{
+	"get": `SELECT id, username, role, alive, locked, locked_until, created, last_seen,
+		rotated_to, rotated_until, flashes, data, fingerprint FROM sessions WHERE id = ?`,
+	"getIPs":      `SELECT ip, allowed FROM session_ips WHERE session_id = ?`,
+	"getAttempts": `SELECT attempts FROM login_attempts WHERE session_id = ?`,
+	"put": `INSERT INTO sessions (id, username, role, alive, locked, locked_until, created, last_seen,
+		rotated_to, rotated_until, flashes, data, fingerprint)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET username = excluded.username, role = excluded.role,
+		alive = excluded.alive, locked = excluded.locked, locked_until = excluded.locked_until,
+		created = excluded.created, last_seen = excluded.last_seen,
+		rotated_to = excluded.rotated_to, rotated_until = excluded.rotated_until,
+		flashes = excluded.flashes, data = excluded.data, fingerprint = excluded.fingerprint`,
+	"putIP": `INSERT INTO session_ips (session_id, ip, allowed) VALUES (?, ?, ?)`,
+	"putAttempts": `INSERT INTO login_attempts (session_id, attempts) VALUES (?, ?)
+		ON CONFLICT (session_id) DO NOTHING`,
+	"incrAttempts":   `UPDATE login_attempts SET attempts = attempts + 1 WHERE session_id = ?`,
+	"resetAttempts":  `UPDATE login_attempts SET attempts = 0 WHERE session_id = ?`,
+	"delete":         `DELETE FROM sessions WHERE id = ?`,
+	"deleteIPs":      `DELETE FROM session_ips WHERE session_id = ?`,
+	"deleteAttempts": `DELETE FROM login_attempts WHERE session_id = ?`,
+	"touch":          `UPDATE sessions SET last_seen = ? WHERE id = ?`,
+	"list": `SELECT id, username, role, alive, locked, locked_until, created, last_seen,
+		rotated_to, rotated_until, flashes, data, fingerprint FROM sessions`,
+	"listIPs":      `SELECT session_id, ip, allowed FROM session_ips`,
+	"listAttempts": `SELECT session_id, attempts FROM login_attempts`,
+	"userIDs":      `SELECT id FROM sessions WHERE username = ?`,
+}
+
+//sqlStore keeps sessions in three tables: one row per session in sessions, the
+//session's allowed and blocked IPs in session_ips, and its login attempts in
+//login_attempts, so that attempts can be counted without touching the rest of the row
+type sqlStore struct {
+	db      *sql.DB
+	dialect Dialect
+	stmts   map[string]*sql.Stmt
+}
+
+//NewSQLStore creates the session tables in db if they don't already exist, brings them up to
+//date with the latest schema, and prepares every statement the store uses. The store doesn't
+//own db, so closing the store leaves db open
+func NewSQLStore(db *sql.DB, dialect Dialect) (*sqlStore, error) {
+	s := &sqlStore{
+		db:      db,
+		dialect: dialect,
+		stmts:   make(map[string]*sql.Stmt),
+	}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	for name, query := range sqlStatements {
+		stmt, err := db.Prepare(s.rebind(query))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Error preparing statement %q: %v", name, err)
+		}
+		s.stmts[name] = stmt
+	}
+	return s, nil
+}
+
+//rebind rewrites the ? placeholders in a query for the store's dialect
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != DialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+//migrate runs every migration the database hasn't seen yet. Each migration runs in its own
+//transaction along with the row that records it, so a failed migration leaves no trace
+func (s *sqlStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS biscuit_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+	var current int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM biscuit_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	for i := current; i < len(sqlMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		//not every driver will run more than one statement per Exec, so split them up
+		for _, stmt := range strings.Split(sqlMigrations[i], ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Error running migration %v: %v", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(s.rebind(`INSERT INTO biscuit_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Close closes the store's prepared statements. It does not close the database
+func (s *sqlStore) Close() error {
+	var err error
+	for _, stmt := range s.stmts {
+		if cerr := stmt.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+//rowScanner is anything we can scan a session row out of
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//scanSession reads one row of sessions into a record
+func scanSession(row rowScanner) (*SessionRecord, error) {
+	rec := &SessionRecord{IPAddress: make(map[string]bool)}
+	var lockedUntil, created, lastSeen, rotatedUntil int64
+	var flashes, data, fingerprint string
+	err := row.Scan(&rec.ID, &rec.Username, &rec.Role, &rec.Alive, &rec.Locked, &lockedUntil, &created, &lastSeen,
+		&rec.RotatedTo, &rotatedUntil, &flashes, &data, &fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if flashes != "" {
+		if err := json.Unmarshal([]byte(flashes), &rec.Flashes); err != nil {
+			return nil, err
+		}
+	}
+	if data != "" { //the values are bytes, which JSON keeps as base64 so the column can stay TEXT
+		if err := json.Unmarshal([]byte(data), &rec.Data); err != nil {
+			return nil, err
+		}
+	}
+	if fingerprint != "" {
+		rec.Fingerprint = &Fingerprint{}
+		if err := json.Unmarshal([]byte(fingerprint), rec.Fingerprint); err != nil {
+			return nil, err
+		}
+	}
+	rec.LockedUntil = fromUnixNano(lockedUntil)
+	rec.Created = fromUnixNano(created)
+	rec.LastSeen = fromUnixNano(lastSeen)
+	rec.RotatedUntil = fromUnixNano(rotatedUntil)
+	return rec, nil
+}
+
+//toUnixNano and fromUnixNano store times as integers, since every database agrees on what
+//an integer is. The zero time is stored as 0
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(i int64) time.Time {
+	if i == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, i)
+}
+
+//Get returns the session with the given ID, along with its IPs and login attempts, all read in
+//one transaction
+func (s *sqlStore) Get(id string) (*SessionRecord, error) {
+	tx, err := s.readTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() //nothing was written, so there's nothing to commit
+	rec, err := scanSession(tx.Stmt(s.stmts["get"]).QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Stmt(s.stmts["getIPs"]).Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		var allowed bool
+		if err := rows.Scan(&ip, &allowed); err != nil {
+			return nil, err
+		}
+		rec.IPAddress[ip] = allowed
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	err = tx.Stmt(s.stmts["getAttempts"]).QueryRow(id).Scan(&rec.Attempts)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//readTx starts a transaction for reads that have to see all the tables at the same moment, so a
+//Put or Touch from another server can't land in between them and leave a record that's half one
+//and half the other. Postgres needs repeatable read for that, since by default it only holds still
+//for one statement at a time. SQLite's transactions already see the database at one moment
+func (s *sqlStore) readTx() (*sql.Tx, error) {
+	opts := &sql.TxOptions{ReadOnly: true}
+	if s.dialect == DialectPostgres {
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	return s.db.BeginTx(context.Background(), opts)
+}
+
+//Put writes the whole session in one transaction, replacing its IP list. The login attempts are
+//only written for a session that doesn't have any yet. After that they only change through
+//IncrAttempts and ResetAttempts, so a Put from one server can't undo another server's count
+func (s *sqlStore) Put(rec *SessionRecord) error {
+	var flashes, data, fingerprint []byte
+	var err error
+	if len(rec.Flashes) > 0 {
+		if flashes, err = json.Marshal(rec.Flashes); err != nil {
+			return err
+		}
+	}
+	if len(rec.Data) > 0 {
+		if data, err = json.Marshal(rec.Data); err != nil {
+			return err
+		}
+	}
+	if rec.Fingerprint != nil {
+		if fingerprint, err = json.Marshal(rec.Fingerprint); err != nil {
+			return err
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.stmts["put"]).Exec(rec.ID, rec.Username, rec.Role, rec.Alive, rec.Locked,
+		toUnixNano(rec.LockedUntil), toUnixNano(rec.Created), toUnixNano(rec.LastSeen),
+		rec.RotatedTo, toUnixNano(rec.RotatedUntil), string(flashes), string(data), string(fingerprint))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Stmt(s.stmts["deleteIPs"]).Exec(rec.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	putIP := tx.Stmt(s.stmts["putIP"])
+	for ip, allowed := range rec.IPAddress {
+		if _, err := putIP.Exec(rec.ID, ip, allowed); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Stmt(s.stmts["putAttempts"]).Exec(rec.ID, rec.Attempts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//Delete removes a session and everything that hangs off of it
+func (s *sqlStore) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.deleteTx(tx, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//deleteTx removes a session from all three tables inside of tx
+func (s *sqlStore) deleteTx(tx *sql.Tx, id string) error {
+	for _, name := range []string{"deleteIPs", "deleteAttempts", "delete"} {
+		if _, err := tx.Stmt(s.stmts[name]).Exec(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Touch updates the time a session was last seen
+func (s *sqlStore) Touch(id string, t time.Time) error {
+	res, err := s.stmts["touch"].Exec(toUnixNano(t), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+//List returns every session in the store. It reads each table once, in one transaction, and
+//stitches the results together, rather than going back to the database for every session
+func (s *sqlStore) List() ([]*SessionRecord, error) {
+	tx, err := s.readTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Stmt(s.stmts["list"]).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byID := make(map[string]*SessionRecord)
+	var recs []*SessionRecord
+	for rows.Next() {
+		rec, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		byID[rec.ID] = rec
+		recs = append(recs, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ipRows, err := tx.Stmt(s.stmts["listIPs"]).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer ipRows.Close()
+	for ipRows.Next() {
+		var id, ip string
+		var allowed bool
+		if err := ipRows.Scan(&id, &ip, &allowed); err != nil {
+			return nil, err
+		}
+		if rec, ok := byID[id]; ok {
+			rec.IPAddress[ip] = allowed
+		}
+	}
+	if err := ipRows.Err(); err != nil {
+		return nil, err
+	}
+
+	attemptRows, err := tx.Stmt(s.stmts["listAttempts"]).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer attemptRows.Close()
+	for attemptRows.Next() {
+		var id string
+		var attempts int
+		if err := attemptRows.Scan(&id, &attempts); err != nil {
+			return nil, err
+		}
+		if rec, ok := byID[id]; ok {
+			rec.Attempts = attempts
+		}
+	}
+	return recs, attemptRows.Err()
+}
+
+//ListByUser returns every session belonging to a user, using the index on username
+func (s *sqlStore) ListByUser(username string) ([]*SessionRecord, error) {
+	rows, err := s.stmts["userIDs"].Query(username)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var recs []*SessionRecord
+	for _, id := range ids {
+		rec, err := s.Get(id)
+		if err == ErrSessionNotFound {
+			continue //deleted since we listed it
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+//DeleteByUser removes every session belonging to a user in one transaction
+func (s *sqlStore) DeleteByUser(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Stmt(s.stmts["userIDs"]).Query(username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, id := range ids {
+		if err := s.deleteTx(tx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//IncrAttempts bumps a session's login attempts in a single UPDATE, so two servers counting
+//attempts for the same session at the same time can't both miss the other's increment
+func (s *sqlStore) IncrAttempts(id string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Stmt(s.stmts["incrAttempts"]).Exec(id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if n == 0 {
+		tx.Rollback()
+		return 0, ErrSessionNotFound
+	}
+	var attempts int
+	if err := tx.Stmt(s.stmts["getAttempts"]).QueryRow(id).Scan(&attempts); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return attempts, tx.Commit()
+}
+
+//ResetAttempts sets a session's login attempts back to 0
+func (s *sqlStore) ResetAttempts(id string) error {
+	_, err := s.stmts["resetAttempts"].Exec(id)
+	return err
+}
@@ -0,0 +1,169 @@
+package biscuit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//this file is for stateless mode, where the session cookie holds the whole session instead of
+//just its ID. Every field of the session is sealed into the cookie with Encrypt, so any server
+//with the same keyring can pick the session up without a shared store. The manager's own store
+//is still there, but it's only a cache of sessions this server has seen, filled in from cookies
+//by ReadSessionCookie. Since the cookie is the real copy of the session, anything that changes a
+//session has to be followed by SetSessionCookie to send the change back to the browser
+
+var maxCookieSize int = 4096 //the most any browser promises to keep for one cookie
+
+//ErrCookieTooLarge is returned when a cookie would be too big for browsers to keep, even split
+//into chunks
+var ErrCookieTooLarge = errors.New("Error: cookie is larger than 4096 bytes")
+
+//ErrSessionRevoked is returned when a stateless session cookie belongs to a session that
+//was logged out. The cookie itself can't be taken back, so it's turned away on sight instead
+var ErrSessionRevoked = errors.New("Error: session has been revoked")
+
+//SetStateless turns stateless mode on or off. Switching modes invalidates every session cookie
+//already handed out, so it should be done before the manager is used
+func (mng *sessionManager) SetStateless(b bool) {
+	mng.mux.Lock()
+	mng.stateless = b
+	mng.mux.Unlock()
+}
+
+//isStateless reports whether the manager is in stateless mode
+func (mng *sessionManager) isStateless() bool {
+	mng.mux.RLock()
+	defer mng.mux.RUnlock()
+	return mng.stateless
+}
+
+//sessionCookieValue returns what goes in a session's cookie: the signed ID normally, or the
+//sealed session in stateless mode, which writeChunked splits up if it has to
+func (mng *sessionManager) sessionCookieValue(sess *session) (string, error) {
+	name := mng.SessionCookie()
+	if mng.isStateless() != true {
+		return mng.getKeyring().sign(name, sess.cookieID, time.Now()), nil
+	}
+	data, err := json.Marshal(sess.record())
+	if err != nil {
+		return "", err
+	}
+	return mng.encrypt(name, data)
+}
+
+//readSessionCookie does the work for ReadSessionCookie, and VerifyCookie when it's handed the
+//session cookie
+func (mng *sessionManager) readSessionCookie(c *http.Cookie) (string, error) {
+	if mng.isStateless() {
+		return mng.openSessionCookie(c)
+	}
+	id, signed, err := mng.getKeyring().verify(c.Name, c.Value)
+	if err != nil {
+		return "", err
+	}
+	mng.mux.RLock()
+	length := mng.sessionLength
+	mng.mux.RUnlock()
+	if length > 0 && time.Since(signed) > time.Second*time.Duration(length) {
+		return "", ErrCookieExpired
+	}
+	return id, nil
+}
+
+//openSessionCookie decrypts a stateless session cookie and puts the session in the manager's
+//store, so everything else can find it by ID like normal. If the store already has the session,
+//the cookie still wins, except for the last time it was seen and the login attempts, which only
+//this server knows. Otherwise replaying an old cookie would wipe out a lockout
+func (mng *sessionManager) openSessionCookie(c *http.Cookie) (string, error) {
+	data, err := mng.decrypt(c.Name, c.Value)
+	if err != nil {
+		return "", err
+	}
+	rec := &SessionRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return "", err
+	}
+	if mng.isRevoked(rec.ID) {
+		return "", ErrSessionRevoked
+	}
+	defer mng.lockSession(rec.ID)()
+	store := mng.getStore()
+	cached, err := store.Get(rec.ID)
+	if err == nil {
+		if cached.LastSeen.After(rec.LastSeen) {
+			rec.LastSeen = cached.LastSeen
+		}
+		rec.Attempts, rec.Locked, rec.LockedUntil = cached.Attempts, cached.Locked, cached.LockedUntil
+	} else if err != ErrSessionNotFound {
+		return "", err
+	}
+	if mng.expired(rec.Created, rec.LastSeen, time.Now()) {
+		return "", fmt.Errorf("Session %q has expired", rec.ID)
+	}
+	if err := store.Put(rec); err != nil {
+		return "", err
+	}
+	return rec.ID, nil
+}
+
+//Revoke turns away any stateless session cookie for the session with the given ID until the
+//given time, which should be when the cookie would have expired anyway. Logout does this
+//for you, this is for passing revocations along to other servers. A zero time never runs out
+func (mng *sessionManager) Revoke(id string, until time.Time) {
+	mng.revokedMux.Lock()
+	mng.revoked[id] = until
+	mng.revokedMux.Unlock()
+}
+
+//revoke adds a session that was just logged out to the revocation list, for as long as its
+//cookie could still be used
+func (mng *sessionManager) revoke(sess *session) {
+	mng.mux.RLock()
+	length, idle := mng.sessionLength, mng.idleTimeout
+	mng.mux.RUnlock()
+	var until time.Time
+	if length > 0 {
+		until = sess.created.Add(time.Second * time.Duration(length))
+	}
+	if idle > 0 {
+		//the cookie can't have been seen any later than this server last saw it
+		idleUntil := sess.lastSeen.Add(time.Second * time.Duration(idle))
+		if until.IsZero() || idleUntil.Before(until) {
+			until = idleUntil
+		}
+	}
+	mng.Revoke(sess.cookieID, until)
+}
+
+//revokeUntil is Revoke, except it never shortens a revocation that's already there
+func (mng *sessionManager) revokeUntil(id string, until time.Time) {
+	mng.revokedMux.Lock()
+	defer mng.revokedMux.Unlock()
+	if old, ok := mng.revoked[id]; ok && (old.IsZero() || old.After(until)) {
+		return
+	}
+	mng.revoked[id] = until
+}
+
+//isRevoked reports whether a session is on the revocation list, and its revocation hasn't run out
+func (mng *sessionManager) isRevoked(id string) bool {
+	mng.revokedMux.Lock()
+	defer mng.revokedMux.Unlock()
+	until, ok := mng.revoked[id]
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+//pruneRevoked drops revocations for cookies that have expired on their own, which keeps the
+//list down to sessions that were logged out recently
+func (mng *sessionManager) pruneRevoked(now time.Time) {
+	mng.revokedMux.Lock()
+	defer mng.revokedMux.Unlock()
+	for id, until := range mng.revoked {
+		if until.IsZero() != true && now.After(until) {
+			delete(mng.revoked, id)
+		}
+	}
+}
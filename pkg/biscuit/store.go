@@ -0,0 +1,186 @@
+package biscuit
+
+import (
+	"errors"
+	"time"
+)
+
+//ErrSessionNotFound is returned by a SessionStore when it has no session for the requested ID
+var ErrSessionNotFound = errors.New("session not found")
+
+//SessionStore is the interface the session manager uses to keep track of its sessions. By default
+//the manager keeps everything in memory, but anything that implements SessionStore can be handed
+//to SetStore, so sessions can live in files, databases, key-value stores, or whatever else
+type SessionStore interface {
+	Get(id string) (*SessionRecord, error) //returns ErrSessionNotFound if the ID isn't in the store
+	Put(rec *SessionRecord) error          //adds the session, or overwrites it if it's already there
+	Delete(id string) error                //deleting a session that doesn't exist is not an error
+	Touch(id string, t time.Time) error    //updates the LastSeen time of a session
+	List() ([]*SessionRecord, error)       //returns every session in the store
+	DeleteByUser(username string) error    //removes every session belonging to a user
+}
+
+//UserLister is implemented by stores that can find a user's sessions without going through every
+//session in the store. Stores that don't implement it still work, the manager just uses List
+type UserLister interface {
+	ListByUser(username string) ([]*SessionRecord, error)
+}
+
+//SessionRecord is a flat copy of a session that gets passed to and from a SessionStore. Everything
+//is exported so that stores can serialize it however they like. Changing a record does nothing
+//until it's put back into the store
+type SessionRecord struct {
+	ID           string
+	Username     string
+	Role         string
+	IPAddress    map[string]bool //false is blocked, while true is allowed
+	Alive        bool
+	Locked       bool
+	LockedUntil  time.Time //when a locked session gets unlocked again
+	Attempts     int
+	Created      time.Time
+	LastSeen     time.Time
+	RotatedTo    string            //set once the session has been given a new ID, which is where it lives now
+	RotatedUntil time.Time         //how long the old ID keeps working after it was rotated
+	Flashes      []Flash           //flash messages waiting to be shown
+	Data         map[string][]byte //the session's values, already encoded, so stores can treat them as opaque bytes
+	Fingerprint  *Fingerprint      //the device the session was started on
+}
+
+//copy returns a deep copy of the record, so that nobody outside the store can change
+//what's inside the store by accident
+func (rec *SessionRecord) copy() *SessionRecord {
+	c := *rec
+	c.IPAddress = make(map[string]bool, len(rec.IPAddress))
+	for ip, ok := range rec.IPAddress {
+		c.IPAddress[ip] = ok
+	}
+	c.Flashes = append([]Flash(nil), rec.Flashes...)
+	if rec.Fingerprint != nil {
+		fp := *rec.Fingerprint
+		c.Fingerprint = &fp
+	}
+	if rec.Data != nil {
+		c.Data = make(map[string][]byte, len(rec.Data))
+		for key, value := range rec.Data {
+			c.Data[key] = append([]byte(nil), value...)
+		}
+	}
+	return &c
+}
+
+//memoryStore is the default SessionStore. It keeps every session in a map, which means
+//sessions don't survive a restart and can't be shared between processes. The map is split
+//into shards so that busy servers aren't all waiting on one lock
+type memoryStore struct {
+	shards []memoryShard
+}
+
+//NewMemoryStore returns an empty in-memory session store. This is what every session
+//manager uses unless it's told otherwise
+func NewMemoryStore() *memoryStore {
+	return newMemoryStore(defaultShardCount)
+}
+
+//newMemoryStore returns an empty in-memory store split into n shards
+func newMemoryStore(n int) *memoryStore {
+	s := &memoryStore{shards: make([]memoryShard, n)}
+	for i := range s.shards {
+		s.shards[i].sessions = make(map[string]*SessionRecord)
+	}
+	return s
+}
+
+//shard returns the shard a session ID lives in
+func (s *memoryStore) shard(id string) *memoryShard {
+	return &s.shards[shardFor(id, len(s.shards))]
+}
+
+//Get returns a copy of the session with the given ID
+func (s *memoryStore) Get(id string) (*SessionRecord, error) {
+	shard := s.shard(id)
+	shard.mux.RLock()
+	defer shard.mux.RUnlock()
+	rec, ok := shard.sessions[id]
+	if ok != true {
+		return nil, ErrSessionNotFound
+	}
+	return rec.copy(), nil
+}
+
+//Put saves a copy of the session record
+func (s *memoryStore) Put(rec *SessionRecord) error {
+	shard := s.shard(rec.ID)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	shard.sessions[rec.ID] = rec.copy()
+	return nil
+}
+
+//Delete removes a session from the store
+func (s *memoryStore) Delete(id string) error {
+	shard := s.shard(id)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	delete(shard.sessions, id)
+	return nil
+}
+
+//Touch updates the time a session was last seen
+func (s *memoryStore) Touch(id string, t time.Time) error {
+	shard := s.shard(id)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	rec, ok := shard.sessions[id]
+	if ok != true {
+		return ErrSessionNotFound
+	}
+	rec.LastSeen = t
+	return nil
+}
+
+//List returns copies of every session in the store. Shards are locked one at a time, so
+//the list is not a snapshot of a single moment
+func (s *memoryStore) List() ([]*SessionRecord, error) {
+	var recs []*SessionRecord
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mux.RLock()
+		for _, rec := range shard.sessions {
+			recs = append(recs, rec.copy())
+		}
+		shard.mux.RUnlock()
+	}
+	return recs, nil
+}
+
+//ListByUser returns copies of every session that belongs to the given username
+func (s *memoryStore) ListByUser(username string) ([]*SessionRecord, error) {
+	var recs []*SessionRecord
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mux.RLock()
+		for _, rec := range shard.sessions {
+			if rec.Username == username {
+				recs = append(recs, rec.copy())
+			}
+		}
+		shard.mux.RUnlock()
+	}
+	return recs, nil
+}
+
+//DeleteByUser removes every session that belongs to the given username
+func (s *memoryStore) DeleteByUser(username string) error {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mux.Lock()
+		for id, rec := range shard.sessions {
+			if rec.Username == username {
+				delete(shard.sessions, id)
+			}
+		}
+		shard.mux.Unlock()
+	}
+	return nil
+}
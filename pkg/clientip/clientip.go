@@ -0,0 +1,183 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*clientip works out which IP address a request really came from. Behind a load balancer or a
+reverse proxy, RemoteAddr is the proxy, and the client is somewhere in a header the proxy added.
+Those headers are easy to fake, though, so they're only believed when the request actually came
+through a proxy we trust, and only as far back as the chain of trusted proxies goes*/
+
+//headers the resolver knows how to read
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded" //RFC 7239
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+//PrivateRanges are the loopback and private networks, which is where proxies usually live. Pass
+//them to NewResolver if your proxies are on the same machine or the same private network
+var PrivateRanges = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+//Resolver finds the client's IP address in a request
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+//Default trusts no proxies, so it always uses RemoteAddr
+var Default = &Resolver{header: HeaderXForwardedFor}
+
+//NewResolver returns a resolver that believes one forwarding header, the one your proxy sets, on
+//requests from the given proxies. They can be CIDRs like "10.0.0.0/8" or single addresses. Only
+//that header is ever read, because a client can send any of the others itself, and a proxy that
+//doesn't know about them passes them along untouched
+func NewResolver(header string, trusted ...string) (*Resolver, error) {
+	res := &Resolver{}
+	if err := res.SetHeader(header); err != nil {
+		return nil, err
+	}
+	for _, t := range trusted {
+		if strings.Contains(t, "/") != true {
+			ip := Parse(t)
+			if ip == nil {
+				return nil, fmt.Errorf("Error: %q is not an IP address or CIDR", t)
+			}
+			bits := 8 * len(ip)
+			res.trusted = append(res.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, fmt.Errorf("Error: %q is not an IP address or CIDR", t)
+		}
+		res.trusted = append(res.trusted, network)
+	}
+	return res, nil
+}
+
+//SetHeader changes which header the resolver reads: HeaderForwarded, HeaderXForwardedFor or
+//HeaderXRealIP. It should be the one your proxy sets, and nothing else
+func (res *Resolver) SetHeader(header string) error {
+	h := http.CanonicalHeaderKey(header)
+	if h != HeaderXForwardedFor && h != HeaderForwarded && h != http.CanonicalHeaderKey(HeaderXRealIP) {
+		return fmt.Errorf("Error: unknown forwarding header %q", header)
+	}
+	res.header = h
+	return nil
+}
+
+//Trusted reports whether ip is one of the resolver's trusted proxies
+func (res *Resolver) Trusted(ip net.IP) bool {
+	for _, network := range res.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//ClientIP returns the address of the client behind a request. If the request didn't come from a
+//trusted proxy, that's RemoteAddr. Otherwise the resolver's header is read from right to left,
+//skipping over trusted proxies, and the first address that isn't one is the client. If the header
+//isn't there, or can't be read, it's RemoteAddr again. It returns an empty string if RemoteAddr
+//isn't an IP address, which can happen in tests
+func (res *Resolver) ClientIP(r *http.Request) string {
+	remote := Parse(r.RemoteAddr)
+	if remote == nil {
+		return ""
+	}
+	if res.Trusted(remote) != true {
+		return remote.String()
+	}
+	values := r.Header.Values(res.header)
+	if len(values) == 0 {
+		return remote.String()
+	}
+	var hops []string
+	switch res.header {
+	case HeaderForwarded:
+		hops = parseForwarded(values)
+	case HeaderXForwardedFor:
+		for _, v := range values {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	default:
+		hops = values[len(values)-1:] //a proxy that sets X-Real-IP replaces it, so only the last one counts
+	}
+	if ip := res.walk(hops); ip != nil {
+		return ip.String()
+	}
+	return remote.String()
+}
+
+//walk goes through a list of hops from right to left, and returns the first one that isn't a
+//trusted proxy. If every hop is trusted, the leftmost is as far back as we can go. If a hop
+//can't be read, the list can't be trusted past it, and walk returns nil
+func (res *Resolver) walk(hops []string) net.IP {
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = Parse(hops[i])
+		if ip == nil {
+			return nil
+		}
+		if res.Trusted(ip) != true {
+			return ip
+		}
+	}
+	return ip
+}
+
+//parseForwarded pulls the for= addresses out of Forwarded headers, like
+//
+//	Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			hop := "" //an element without for= is a hop we can't read
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = strings.Trim(kv[1], `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+//Parse reads an IP address the way it turns up in RemoteAddr and forwarding headers: with or
+//without a port, with or without brackets around IPv6, and maybe with a zone. IPv4 addresses
+//written as IPv6, like ::ffff:192.0.2.1, come back as plain IPv4. It returns nil if s isn't an
+//IP address at all, like the "unknown" or "_hidden" a Forwarded header can have
+func Parse(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,108 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for in, want := range map[string]string{
+		"192.0.2.1":              "192.0.2.1",
+		"192.0.2.1:8080":         "192.0.2.1",
+		"::ffff:192.0.2.1":       "192.0.2.1",
+		"[::ffff:192.0.2.1]:443": "192.0.2.1",
+		"[2001:db8::1]:4711":     "2001:db8::1",
+		"[2001:db8::1]":          "2001:db8::1",
+		"fe80::1%eth0":           "fe80::1",
+		" 10.0.0.1 ":             "10.0.0.1",
+	} {
+		if got := Parse(in); got == nil || got.String() != want {
+			t.Errorf("Parse(%q) = %v, expected %v", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "unknown", "_hidden", "example.com", "192.0.2.1, 10.0.0.1"} {
+		if got := Parse(in); got != nil {
+			t.Errorf("Parse(%q) = %v, expected nil", in, got)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	res, err := NewResolver(HeaderXForwardedFor, "10.0.0.0/8", "2001:db8::10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewResolver(HeaderXForwardedFor, "not an ip"); err == nil {
+		t.Error("accepted a bad proxy")
+	}
+	if _, err := NewResolver("X-Client-IP", "10.0.0.0/8"); err == nil {
+		t.Error("accepted an unknown header")
+	}
+	request := func(remote string, headers map[string][]string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		for h, values := range headers {
+			for _, v := range values {
+				r.Header.Add(h, v)
+			}
+		}
+		return res.ClientIP(r)
+	}
+
+	//headers from clients we don't trust are ignored
+	if got := request("203.0.113.5:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}); got != "203.0.113.5" {
+		t.Errorf("untrusted remote: got %v", got)
+	}
+	if got := Default.ClientIP(httptest.NewRequest("GET", "/", nil)); got != "192.0.2.1" {
+		t.Errorf("default resolver: got %v", got)
+	}
+
+	//walking right to left stops at the first address that isn't a proxy, so whatever the client
+	//put at the front of the header doesn't matter
+	xff := map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7", "10.1.1.1"}}
+	if got := request("10.0.0.2:80", xff); got != "198.51.100.7" {
+		t.Errorf("X-Forwarded-For: got %v", got)
+	}
+	if got := request("10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"10.0.0.9, 10.0.0.8"}}); got != "10.0.0.9" {
+		t.Errorf("all proxies: got %v", got)
+	}
+	if got := request("10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"198.51.100.7, garbage"}}); got != "10.0.0.2" {
+		t.Errorf("unreadable hop: got %v", got)
+	}
+
+	//a client can send its own Forwarded header through a proxy that only appends to
+	//X-Forwarded-For, so it's never read unless it's the header we asked for
+	spoofed := map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"203.0.113.9"}}
+	if got := request("10.0.0.2:80", spoofed); got != "203.0.113.9" {
+		t.Errorf("spoofed Forwarded: got %v", got)
+	}
+	if got := request("10.0.0.2:80", map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}}); got != "10.0.0.2" {
+		t.Errorf("spoofed headers without X-Forwarded-For: got %v", got)
+	}
+
+	//and when the header can't be read, it doesn't fall back to another one
+	if got := request("10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"garbage"}, "X-Real-Ip": {"198.51.100.2"}}); got != "10.0.0.2" {
+		t.Errorf("fell through to another header: got %v", got)
+	}
+
+	if err := res.SetHeader(HeaderForwarded); err != nil {
+		t.Fatal(err)
+	}
+	fwd := map[string][]string{"Forwarded": {`for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https, for="[2001:db8::10]";by=10.0.0.1`}}
+	if got := request("[::ffff:10.0.0.2]:80", fwd); got != "2001:db8:cafe::17" {
+		t.Errorf("Forwarded: got %v", got)
+	}
+	if got := request("10.0.0.2:80", xff); got != "10.0.0.2" {
+		t.Errorf("header we didn't ask for: got %v", got)
+	}
+
+	if err := res.SetHeader("x-real-ip"); err != nil {
+		t.Fatal(err)
+	}
+	if got := request("10.0.0.2:80", map[string][]string{"X-Real-Ip": {"198.51.100.9"}}); got != "198.51.100.9" {
+		t.Errorf("X-Real-IP: got %v", got)
+	}
+	if err := res.SetHeader("X-Client-IP"); err == nil {
+		t.Error("accepted an unknown header")
+	}
+}